@@ -0,0 +1,188 @@
+package drift
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "path"
+  "bufio"
+  "bytes"
+  "strings"
+  "io/ioutil"
+  "archive/tar"
+  "archive/zip"
+  "compress/gzip"
+)
+
+// ZipFS is a FileSystem over a .zip archive, so a bundle of revisions can be
+// applied without unpacking it
+// entries stored without compression are read straight from the archive,
+// compressed entries are inflated in to memory when they're opened
+// e.g. fs, err := OpenZipFS("migrations-1.4.zip")
+//      defer fs.Close()
+//      revs, err := ReadRevisions("migrations", fs)
+type ZipFS struct {
+  r      io.ReaderAt
+  zr     *zip.Reader
+  files  map[string]*zip.File   // keyed by clean absolute path
+  dirs   FileSystem             // the archive as an fs.FS, for directories
+  closer io.Closer
+}
+
+// creates a ZipFS over a zip archive of size bytes
+func NewZipFS(r io.ReaderAt, size int64) (*ZipFS, error) {
+  zr, err := zip.NewReader(r, size)
+  if err != nil {
+    return nil, err
+  }
+  z := &ZipFS{r: r, zr: zr, files: make(map[string]*zip.File), dirs: FromIOFS(zr)}
+  for _, f := range(zr.File) {
+    z.files[memPath(f.Name)] = f
+  }
+  return z, nil
+}
+
+// opens a zip archive on the local disk, the ZipFS must be closed
+func OpenZipFS(name string) (*ZipFS, error) {
+  f, err := os.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, err
+  }
+  z, err := NewZipFS(f, info.Size())
+  if err != nil {
+    f.Close()
+    return nil, fmt.Errorf("%s: %v", name, err)
+  }
+  z.closer = f
+  return z, nil
+}
+
+// closes the archive, if the ZipFS opened it
+func (z *ZipFS) Close() error {
+  if z.closer == nil {
+    return nil
+  }
+  return z.closer.Close()
+}
+
+func (z *ZipFS) Open(name string) (File, error) {
+  f, ok := z.files[memPath(name)]
+  if !ok || f.FileInfo().IsDir() {
+    return z.dirs.Open(name)
+  }
+  if f.Method == zip.Store {
+    offset, err := f.DataOffset()
+    if err != nil {
+      return nil, memError("open", name, err)
+    }
+    section := io.NewSectionReader(z.r, offset, int64(f.UncompressedSize64))
+    return &memHandle{section, f.FileInfo()}, nil
+  }
+  rc, err := f.Open()
+  if err != nil {
+    return nil, memError("open", name, err)
+  }
+  defer rc.Close()
+  data, err := ioutil.ReadAll(rc)
+  if err != nil {
+    return nil, memError("open", name, err)
+  }
+  return &memHandle{bytes.NewReader(data), f.FileInfo()}, nil
+}
+
+func (z *ZipFS) Stat(name string) (os.FileInfo, error) {
+  return z.dirs.Stat(name)
+}
+
+func (z *ZipFS) ReadDir(name string) ([]os.FileInfo, error) {
+  return z.dirs.ReadDir(name)
+}
+
+// Reads a tar archive in to a MemFS, gzipped archives (.tar.gz, .tgz) are
+// unzipped as they're read
+// tar archives can't be read from at random, so the whole archive is held in
+// memory, only regular files and directories are kept, links and other
+// entries are skipped
+// e.g. fs, err := NewTarFS(resp.Body)
+func NewTarFS(r io.Reader) (*MemFS, error) {
+  br := bufio.NewReader(r)
+  // gzip streams start 1f 8b
+  if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+    gz, err := gzip.NewReader(br)
+    if err != nil {
+      return nil, err
+    }
+    defer gz.Close()
+    r = gz
+  } else {
+    r = br
+  }
+
+  fs := NewMemFS()
+  tr := tar.NewReader(r)
+  for {
+    header, err := tr.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    mode := os.FileMode(header.Mode).Perm()
+    switch header.Typeflag {
+    case tar.TypeDir:
+      err = fs.MkdirAll(header.Name, mode)
+    case tar.TypeReg:
+      var data []byte
+      if data, err = ioutil.ReadAll(tr); err == nil {
+        err = fs.write(header.Name, data, mode, header.ModTime)
+      }
+    }
+    if err != nil {
+      return nil, fmt.Errorf("%s: %v", header.Name, err)
+    }
+  }
+  return fs, nil
+}
+
+// reads a tar archive on the local disk in to a MemFS, see NewTarFS
+func OpenTarFS(name string) (*MemFS, error) {
+  f, err := os.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  fs, err := NewTarFS(f)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", name, err)
+  }
+  return fs, nil
+}
+
+// Opens a .zip, .tar, .tar.gz or .tgz archive on the local disk as a
+// FileSystem, picking the format from the extension
+// the io.Closer closes the archive once the revisions have been read
+// e.g. fs, closer, err := OpenArchive("migrations-1.4.tar.gz")
+func OpenArchive(name string) (FileSystem, io.Closer, error) {
+  lower := strings.ToLower(name)
+  switch {
+  case path.Ext(lower) == ".zip":
+    z, err := OpenZipFS(name)
+    if err != nil {
+      return nil, nil, err
+    }
+    return z, z, nil
+  case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+    fs, err := OpenTarFS(name)
+    if err != nil {
+      return nil, nil, err
+    }
+    return fs, ioutil.NopCloser(nil), nil
+  }
+  return nil, nil, fmt.Errorf("%s is not a .zip, .tar, .tar.gz or .tgz archive", name)
+}
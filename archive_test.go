@@ -0,0 +1,183 @@
+package drift
+
+import (
+  "os"
+  "time"
+  "bytes"
+  "errors"
+  "testing"
+  "io/ioutil"
+  "archive/tar"
+  "archive/zip"
+  "compress/gzip"
+  "path/filepath"
+)
+
+// the revisions put in every test archive
+var archiveRevisions = []struct{
+  name string
+  data string
+}{
+  {"migrations/V2.sql", "--+ changeset id:2\nSELECT 2;"},
+  {"migrations/V1.sql", "--+ changeset id:1\nSELECT 1;"},
+  {"migrations/views/v1.sql", "--+ changeset id:1\nSELECT 3;"},
+  {"migrations/README.md", "not a revision"},
+}
+
+// a zip of the test revisions, alternately stored and deflated
+func testZip(t *testing.T) []byte {
+  var buf bytes.Buffer
+  w := zip.NewWriter(&buf)
+  for i, rev := range(archiveRevisions) {
+    method := zip.Store
+    if i % 2 == 1 {
+      method = zip.Deflate
+    }
+    f, err := w.CreateHeader(&zip.FileHeader{Name: rev.name, Method: method})
+    if err != nil {
+      t.Fatal(err)
+    }
+    f.Write([]byte(rev.data))
+  }
+  if err := w.Close(); err != nil {
+    t.Fatal(err)
+  }
+  return buf.Bytes()
+}
+
+// a tar of the test revisions, gzipped if compress is true
+func testTar(t *testing.T, compress bool) []byte {
+  var buf bytes.Buffer
+  var gz *gzip.Writer
+  w := tar.NewWriter(&buf)
+  if compress {
+    gz = gzip.NewWriter(&buf)
+    w = tar.NewWriter(gz)
+  }
+  w.WriteHeader(&tar.Header{Name: "migrations/", Typeflag: tar.TypeDir, Mode: 0755})
+  w.WriteHeader(&tar.Header{Name: "migrations/latest", Typeflag: tar.TypeSymlink, Linkname: "V2.sql"})
+  for _, rev := range(archiveRevisions) {
+    w.WriteHeader(&tar.Header{
+      Name:     rev.name,
+      Typeflag: tar.TypeReg,
+      Mode:     0644,
+      Size:     int64(len(rev.data)),
+      ModTime:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+    })
+    w.Write([]byte(rev.data))
+  }
+  if err := w.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if compress {
+    gz.Close()
+  }
+  return buf.Bytes()
+}
+
+// reads the test revisions from an archive filesystem
+func checkArchive(t *testing.T, fs FileSystem) {
+  t.Helper()
+  revisions, err := ReadRevisions("migrations", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revisionPaths(revisions) != "migrations/V1.sql|migrations/V2.sql|migrations/views/v1.sql" {
+    t.Errorf("unexpected revisions %v", revisionPaths(revisions))
+  }
+  for _, rev := range(revisions) {
+    changesets, err := ParseChangesets(rev)
+    if err != nil || len(changesets) != 1 {
+      t.Errorf("unexpected changesets %v %v", changesets, err)
+    }
+  }
+  for _, rev := range(archiveRevisions) {
+    f, err := fs.Open(rev.name)
+    if err != nil {
+      t.Fatal(err)
+    }
+    // entries can be read at an offset and seeked
+    out := make([]byte, 4)
+    if _, err := f.ReadAt(out, 2); err != nil || string(out) != rev.data[2:6] {
+      t.Errorf("expected %q got %q %v", rev.data[2:6], out, err)
+    }
+    f.Seek(1, 0)
+    rest, _ := ioutil.ReadAll(f)
+    if string(rest) != rev.data[1:] {
+      t.Errorf("expected %q got %q", rev.data[1:], rest)
+    }
+    info, _ := f.Stat()
+    if info.Size() != int64(len(rev.data)) {
+      t.Errorf("expected size %v got %v", len(rev.data), info.Size())
+    }
+    f.Close()
+  }
+  if _, err := fs.Open("migrations/V3.sql"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing file to not exist got %v", err)
+  }
+  if info, err := fs.Stat("/migrations/views"); err != nil || !info.IsDir() {
+    t.Errorf("expected views to be a directory got %v %v", info, err)
+  }
+}
+
+func TestZipFS(t *testing.T) {
+  data := testZip(t)
+  fs, err := NewZipFS(bytes.NewReader(data), int64(len(data)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkArchive(t, fs)
+
+  if _, err := NewZipFS(bytes.NewReader([]byte("not a zip")), 9); err == nil {
+    t.Errorf("expected a bad archive to error")
+  }
+}
+
+func TestTarFS(t *testing.T) {
+  for _, compress := range([]bool{false, true}) {
+    fs, err := NewTarFS(bytes.NewReader(testTar(t, compress)))
+    if err != nil {
+      t.Fatal(err)
+    }
+    checkArchive(t, fs)
+    info, _ := fs.Stat("migrations/V1.sql")
+    if !info.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) || info.Mode() != 0644 {
+      t.Errorf("unexpected file info %v %v", info.ModTime(), info.Mode())
+    }
+    if _, err := fs.Stat("migrations/latest"); err == nil {
+      t.Errorf("expected links to be skipped")
+    }
+  }
+  if _, err := NewTarFS(bytes.NewReader([]byte{0x1f, 0x8b, 0})); err == nil {
+    t.Errorf("expected a bad archive to error")
+  }
+}
+
+func TestOpenArchive(t *testing.T) {
+  dir := t.TempDir()
+  for name, data := range(map[string][]byte{
+    "bundle.zip":    testZip(t),
+    "bundle.tar":    testTar(t, false),
+    "bundle.tar.gz": testTar(t, true),
+    "bundle.TGZ":    testTar(t, true),
+  }) {
+    p := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(p, data, 0644); err != nil {
+      t.Fatal(err)
+    }
+    fs, closer, err := OpenArchive(p)
+    if err != nil {
+      t.Fatal(err)
+    }
+    checkArchive(t, fs)
+    if err := closer.Close(); err != nil {
+      t.Error(err)
+    }
+  }
+  if _, _, err := OpenArchive(filepath.Join(dir, "bundle.rar")); err == nil {
+    t.Errorf("expected an unknown archive to error")
+  }
+  if _, _, err := OpenArchive(filepath.Join(dir, "missing.zip")); err == nil {
+    t.Errorf("expected a missing archive to error")
+  }
+}
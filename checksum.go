@@ -0,0 +1,85 @@
+package drift
+
+import (
+  "io"
+  "fmt"
+  "strings"
+  "crypto/sha256"
+  "encoding/hex"
+)
+
+// returns a checksum of the sql that only changes when the statements do
+// the sql is normalized first: comments and whitespace are dropped, so
+// reformatting or commenting a changeset that has already been applied
+// doesn't count as editing it, t(id int) hashes like t (id int)
+// strings and quoted identifiers are hashed as written
+// sql that only differs by whitespace between words (a b and ab) hashes the
+// same, an edit like that can't have been meant to change the changeset
+// nested says whether block comments nest, see Scanner.SetNestedComments, and
+// backslash whether a backslash escapes quotes, see Scanner.SetBackslashEscapes
+func checksum(sql string, nested bool, backslash bool) string {
+  h := sha256.New()
+  s := NewScanner([]byte(sql))
+  s.SetNestedComments(nested)
+  s.SetBackslashEscapes(backslash)
+  for s.HasMoreTokens() {
+    tok, err := s.NextToken()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      // anything the scanner can't make sense of is hashed as is
+      sum := sha256.Sum256([]byte(sql))
+      return hex.EncodeToString(sum[:])
+    }
+    h.Write([]byte(string(tok.runes)))
+  }
+  return hex.EncodeToString(h.Sum(nil))
+}
+
+// the checksum of the changeset's sql
+func (c *Changeset) Checksum() string {
+  return checksum(c.sql, c.nested, c.backslash)
+}
+
+// A ChecksumError is an applied changeset whose sql has since been edited
+type ChecksumError struct {
+  Path     string
+  ID       string
+  Expected string   // checksum recorded in the history table
+  Actual   string   // checksum of the changeset as it is now
+}
+
+func (e *ChecksumError) Error() string {
+  return fmt.Sprintf("%s: changeset %s has been edited since it was applied (checksum was %s now %s)",
+    e.Path, e.ID, e.Expected, e.Actual)
+}
+
+// ChecksumErrors are all of the edited changesets found by Validate
+type ChecksumErrors []*ChecksumError
+
+func (e ChecksumErrors) Error() string {
+  switch len(e) {
+  case 0:
+    return "no errors"
+  case 1:
+    return e[0].Error()
+  }
+  return fmt.Sprintf("%s (and %d more errors)", e[0].Error(), len(e) - 1)
+}
+
+// one error per line
+func (e ChecksumErrors) Detail() string {
+  var details []string
+  for _, err := range(e) {
+    details = append(details, err.Error())
+  }
+  return strings.Join(details, "\n")
+}
+
+// test if an applied changeset has been edited since its entry was recorded
+// entries without a checksum predate checksums so there's nothing to compare
+func edited(entry *HistoryEntry, cs *Changeset) bool {
+  return entry != nil && entry.Status.applied() && len(entry.Checksum) > 0 &&
+    entry.Checksum != cs.Checksum()
+}
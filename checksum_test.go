@@ -0,0 +1,89 @@
+package drift
+
+import (
+  "testing"
+)
+
+func TestChecksum(t *testing.T) {
+  sql := "CREATE TABLE t (a int);\nINSERT INTO t VALUES (1);"
+  expected := checksum(sql, false, false)
+  if len(expected) != 64 {
+    t.Errorf("expected a sha256 hex digest got '%v'", expected)
+  }
+  // formatting and comments don't change the checksum
+  for _, value := range([]string{
+    "CREATE TABLE t (a int);\nINSERT INTO t VALUES (1);",
+    "  CREATE   TABLE t (a int);\n\n\tINSERT INTO t VALUES (1);  ",
+    "-- create the table\nCREATE TABLE t (a int); // and fill it\nINSERT INTO t VALUES (1);",
+    "CREATE TABLE t /* the table */ (a int);\r\nINSERT INTO t VALUES (1);",
+    "CREATE TABLE t(a int);\nINSERT INTO t VALUES ( 1 );",
+  }) {
+    if checksum(value, false, false) != expected {
+      t.Errorf("expected the checksum of '%v' to match", value)
+    }
+  }
+  // changing the statements does
+  for _, value := range([]string{
+    "CREATE TABLE t (a int);\nINSERT INTO t VALUES (2);",
+    "CREATE TABLE t (a int);",
+    "create table t (a int);\ninsert into t values (1);",
+  }) {
+    if checksum(value, false, false) == expected {
+      t.Errorf("expected the checksum of '%v' to differ", value)
+    }
+  }
+}
+
+// whitespace and comment markers inside quotes are part of the statement
+func TestChecksumQuoted(t *testing.T) {
+  expected := checksum("SELECT 'a  b', \"x -- y\" FROM t WHERE c='d';", false, false)
+  if checksum("SELECT  'a  b',\n\"x -- y\" FROM t WHERE c='d'; -- done", false, false) != expected {
+    t.Errorf("expected reformatting outside of quotes to keep the checksum")
+  }
+  for _, value := range([]string{
+    "SELECT 'a b', \"x -- y\" FROM t WHERE c='d';",
+    "SELECT 'a  b', \"x --  y\" FROM t WHERE c='d';",
+    "SELECT 'a  b', \"x -- y\" FROM t WHERE c='e';",
+  }) {
+    if checksum(value, false, false) == expected {
+      t.Errorf("expected the checksum of '%v' to differ", value)
+    }
+  }
+  // whitespace next to quotes doesn't count either
+  if checksum("x='a' y", false, false) != checksum("x = 'a'y", false, false) || checksum("a b", false, false) != checksum("a /* c */ b", false, false) {
+    t.Errorf("expected the checksums to match")
+  }
+}
+
+func TestChangesetChecksum(t *testing.T) {
+  changesets, err := ParseChangesets(&Revision{data: []byte(`
+--+ changeset id:1
+SELECT 1;
+--+ changeset id:2
+-- same statement different comment
+SELECT   1;`), path: "/tmp/1.sql"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if changesets[0].Checksum() != changesets[1].Checksum() {
+    t.Errorf("expected checksums to match")
+  }
+}
+
+// whitespace outside of quotes doesn't count anywhere
+func TestChecksumWhitespace(t *testing.T) {
+  for _, value := range([][2]string{
+    {"a;b", "a; b"},
+    {"t(id int)", "t (id int)"},
+    {"a ,b", "a,b"},
+    {"a; b", "a;\n\t  b"},
+    {"t (id int)", "t   (id\nint)"},
+  }) {
+    if checksum(value[0], false, false) != checksum(value[1], false, false) {
+      t.Errorf("expected '%v' and '%v' to match", value[0], value[1])
+    }
+  }
+  if checksum("'a b'", false, false) == checksum("'ab'", false, false) {
+    t.Errorf("expected whitespace in a string to count")
+  }
+}
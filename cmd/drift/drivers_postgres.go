@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// links in the postgres driver, build with -tags postgres
+import _ "github.com/lib/pq"
@@ -0,0 +1,7 @@
+//go:build ql
+// +build ql
+
+package main
+
+// links in the ql driver, build with -tags ql
+import _ "modernc.org/ql"
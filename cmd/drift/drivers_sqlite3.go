@@ -0,0 +1,7 @@
+//go:build sqlite3
+// +build sqlite3
+
+package main
+
+// links in the sqlite3 driver, build with -tags sqlite3
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,167 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "sort"
+  "sync"
+  "strings"
+  "testing"
+  "database/sql"
+  "database/sql/driver"
+
+  "github.com/ascotan/drift"
+)
+
+// ----------------------------------------------------------------------------
+// database/sql driver mock
+// ----------------------------------------------------------------------------
+// a database the commands can be run against, the dsn names it
+// statements containing one of the fail strings return the matching error,
+// statements against the history table are stored as rows of its columns and
+// anything else is recorded and otherwise ignored
+type fakeDB struct {
+  mu       sync.Mutex
+  executed []string
+  fail     map[string]error
+  created  bool
+  history  [][]driver.Value
+}
+
+var fakeDBs = struct{
+  sync.Mutex
+  dbs map[string]*fakeDB
+}{dbs: make(map[string]*fakeDB)}
+
+func init() {
+  sql.Register("fake", fakeDriver{})
+}
+
+// creates a fake database named after the test, returning its dsn
+func newFakeDB(t *testing.T) (string, *fakeDB) {
+  fake := &fakeDB{fail: make(map[string]error)}
+  fakeDBs.Lock()
+  fakeDBs.dbs[t.Name()] = fake
+  fakeDBs.Unlock()
+  return t.Name(), fake
+}
+
+// the statements run so far
+func (db *fakeDB) statements() []string {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  return append([]string(nil), db.executed...)
+}
+
+func (db *fakeDB) exec(query string, args []driver.Value) (driver.Result, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  for match, err := range(db.fail) {
+    if strings.Contains(query, match) {
+      return nil, err
+    }
+  }
+  if !strings.Contains(query, " " + drift.DefaultHistoryTable + " ") {
+    db.executed = append(db.executed, query)
+    return driver.RowsAffected(1), nil
+  }
+  switch {
+  case strings.HasPrefix(query, "CREATE TABLE"):
+    db.created = true
+  case strings.HasPrefix(query, "INSERT INTO"):
+    db.history = append(db.history, args)
+  case strings.HasPrefix(query, "UPDATE"):
+    // author, checksum, dateexecuted, elapsed, status, orderexecuted, revision, changeset
+    for _, row := range(db.history) {
+      if row[0] == args[6] && row[1] == args[7] {
+        copy(row[2:], args[:6])
+      }
+    }
+  case strings.HasPrefix(query, "DELETE FROM"):
+    // revision, changeset
+    for i, row := range(db.history) {
+      if row[0] == args[0] && row[1] == args[1] {
+        db.history = append(db.history[:i], db.history[i+1:]...)
+        break
+      }
+    }
+  default:
+    return nil, fmt.Errorf("fake: unsupported statement %s", query)
+  }
+  return driver.RowsAffected(1), nil
+}
+
+func (db *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  // a count of tables named like the history table checks it exists
+  if len(args) == 1 && args[0] == drift.DefaultHistoryTable && strings.HasPrefix(query, "SELECT count(*)") {
+    exists := int64(0)
+    if db.created {
+      exists = 1
+    }
+    return &fakeRows{[]string{"count"}, [][]driver.Value{{exists}}}, nil
+  }
+  if !strings.Contains(query, " " + drift.DefaultHistoryTable + " ") || !strings.HasPrefix(query, "SELECT") {
+    return nil, fmt.Errorf("fake: unsupported query %s", query)
+  }
+  if !db.created {
+    return nil, fmt.Errorf("fake: no table %s", drift.DefaultHistoryTable)
+  }
+  rows := append([][]driver.Value(nil), db.history...)
+  sort.SliceStable(rows, func(i, j int) bool {
+    return rows[i][7].(int64) < rows[j][7].(int64)
+  })
+  return &fakeRows{make([]string, 8), rows}, nil
+}
+
+type fakeDriver struct{}
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+  fakeDBs.Lock()
+  defer fakeDBs.Unlock()
+  db, exists := fakeDBs.dbs[name]
+  if !exists {
+    return nil, fmt.Errorf("fake: no database named %s", name)
+  }
+  return &fakeConn{db}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+  return &fakeStmt{c.db, query}, nil
+}
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+func (fakeTx) Commit() error { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+  db    *fakeDB
+  query string
+}
+func (s *fakeStmt) Close() error { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+  return s.db.exec(s.query, args)
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+  return s.db.query(s.query, args)
+}
+
+// rows returned from a fake query
+type fakeRows struct {
+  columns []string
+  rows    [][]driver.Value
+}
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+  if len(r.rows) == 0 {
+    return io.EOF
+  }
+  copy(dest, r.rows[0])
+  r.rows = r.rows[1:]
+  return nil
+}
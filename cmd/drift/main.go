@@ -0,0 +1,384 @@
+// The drift command applies sql revisions to a database
+// e.g. drift migrate -driver postgres -dsn postgres://localhost/app -path migrations
+//
+// database/sql drivers are linked in with build tags, see drivers_*.go
+// e.g. go build -tags 'postgres mysql' ./cmd/drift
+package main
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "flag"
+  "errors"
+  "strings"
+  "database/sql"
+  "path/filepath"
+  "text/tabwriter"
+
+  "github.com/ascotan/drift"
+)
+
+// exit codes
+const (
+  exitOK      = 0   // the command succeeded
+  exitFailed  = 1   // the command ran and failed, a migration error, bad revisions...
+  exitUsage   = 2   // the command line was wrong
+  exitPending = 3   // status -check found changesets to apply
+  exitConfig  = 4   // the config couldn't be used, a parse error, unset variable...
+)
+
+// a subcommand
+type command struct {
+  name  string
+  usage string
+  db    bool   // needs a database connection
+  run   func(c *cli) error
+}
+
+var commands = []*command{
+  {"status", "lists the changesets the next migrate will apply", true, status},
+  {"migrate", "applies every pending changeset", true, migrate},
+  {"rollback", "undoes the last -count changesets or those after -to", true, rollback},
+  {"validate", "checks the revisions parse and applied changesets are unchanged", true, validate},
+  {"history", "lists the changesets applied to the database", true, history},
+  {"parse", "parses the revisions and lists their changesets", false, parse},
+}
+
+// what a command runs with
+type cli struct {
+  flags    *flag.FlagSet
+  out      io.Writer
+  config   *drift.Config   // the settings from the config file, env and flags
+  given    drift.Config    // the settings given as flags
+  file     string          // the config file
+  profile  string
+  contexts string
+  check  bool     // status, exit with exitPending if anything is pending
+  count  int      // rollback
+  to     string   // rollback
+
+  revisions []*drift.Revision
+  db        *sql.DB
+  migrator  *drift.Migrator
+}
+
+func main() {
+  os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// runs a command line returning the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+  if len(args) == 0 {
+    usage(stderr)
+    return exitUsage
+  }
+  var cmd *command
+  for _, c := range(commands) {
+    if c.name == args[0] {
+      cmd = c
+    }
+  }
+  if cmd == nil {
+    if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+      usage(stdout)
+      return exitOK
+    }
+    fmt.Fprintf(stderr, "drift: unknown command '%s'\n", args[0])
+    usage(stderr)
+    return exitUsage
+  }
+
+  c := &cli{flags: flag.NewFlagSet("drift " + cmd.name, flag.ContinueOnError), out: stdout}
+  c.flags.SetOutput(stderr)
+  c.flags.StringVar(&c.file, "config", "", "config file, DRIFT_CONFIG or " + strings.Join(drift.DefaultConfigFiles, ", ") + " if not given and it exists")
+  c.flags.StringVar(&c.profile, "profile", "", "config profile to use, DRIFT_PROFILE if not given")
+  c.flags.StringVar(&c.given.Path, "path", "", "revision file, directory or .zip/.tar.gz bundle")
+  c.flags.StringVar(&c.given.Driver, "driver", "", "database/sql driver name")
+  c.flags.StringVar(&c.given.DBMS, "dbms", "", "database the changesets target, the driver name if not given")
+  if cmd.db {
+    c.flags.StringVar(&c.given.DSN, "dsn", "", "data source name passed to the driver")
+    c.flags.StringVar(&c.given.Table, "table", "", "history table name")
+    c.flags.StringVar(&c.contexts, "contexts", "", "comma separated contexts to run changesets in")
+  }
+  switch cmd.name {
+  case "status":
+    c.flags.BoolVar(&c.check, "check", false, fmt.Sprintf("exit %d if there are pending changesets", exitPending))
+  case "rollback":
+    c.flags.IntVar(&c.count, "count", 1, "number of changesets to roll back")
+    c.flags.StringVar(&c.to, "to", "", "roll back every changeset applied after this one, id or path::id")
+  }
+  if err := c.flags.Parse(args[1:]); err != nil {
+    if err == flag.ErrHelp {
+      return exitOK
+    }
+    return exitUsage
+  }
+  if c.flags.NArg() > 0 {
+    fmt.Fprintf(stderr, "drift %s: unexpected argument '%s'\n", cmd.name, c.flags.Arg(0))
+    return exitUsage
+  }
+  if err := c.configure(); err != nil {
+    fmt.Fprintf(stderr, "drift %s: %v\n", cmd.name, err)
+    return exitConfig
+  }
+  if missing := c.missing(cmd); len(missing) > 0 {
+    fmt.Fprintf(stderr, "drift %s: -%s is required (or DRIFT_%s, or %s in the config)\n",
+      cmd.name, missing, strings.ToUpper(missing), missing)
+    c.flags.Usage()
+    return exitUsage
+  }
+
+  err := c.open(cmd)
+  if err == nil {
+    err = cmd.run(c)
+  }
+  if c.db != nil {
+    c.db.Close()
+  }
+  var pending errPending
+  if errors.As(err, &pending) {
+    return exitPending
+  }
+  if err != nil {
+    printError(stderr, cmd.name, err)
+    return exitFailed
+  }
+  return exitOK
+}
+
+// works out the settings, flags take precedence over DRIFT_ environment
+// variables which take precedence over the config file
+func (c *cli) configure() error {
+  file := c.file
+  if len(file) == 0 {
+    file = os.Getenv("DRIFT_CONFIG")
+  }
+  if len(file) == 0 {
+    for _, name := range(drift.DefaultConfigFiles) {
+      if _, err := os.Stat(name); err == nil {
+        file = name
+        break
+      }
+    }
+  }
+  profile := c.profile
+  if len(profile) == 0 {
+    profile = os.Getenv("DRIFT_PROFILE")
+  }
+
+  config := &drift.Config{}
+  if len(file) > 0 {
+    read, err := drift.ReadConfig(file, drift.OSFileSystem{})
+    if err != nil {
+      return err
+    }
+    config = read
+  }
+  config, err := config.Resolve(profile, nil)
+  if err != nil {
+    return err
+  }
+  config.Merge(drift.EnvConfig(nil))
+  for _, context := range(strings.Split(c.contexts, ",")) {
+    if context = strings.TrimSpace(context); len(context) > 0 {
+      c.given.Contexts = append(c.given.Contexts, context)
+    }
+  }
+  config.Merge(&c.given)
+  c.config = config
+  return nil
+}
+
+// the first required setting that wasn't given
+func (c *cli) missing(cmd *command) string {
+  switch {
+  case len(c.config.Path) == 0:
+    return "path"
+  case cmd.db && len(c.config.Driver) == 0:
+    return "driver"
+  case cmd.db && len(c.config.DSN) == 0:
+    return "dsn"
+  }
+  return ""
+}
+
+// reads the revisions and connects to the database
+func (c *cli) open(cmd *command) error {
+  revisions, err := readRevisions(c.config.Path)
+  if err != nil {
+    return err
+  }
+  c.revisions = revisions
+  if !cmd.db {
+    return nil
+  }
+  c.db, err = sql.Open(c.config.Driver, c.config.DSN)
+  if err != nil {
+    return err
+  }
+  c.migrator, err = c.config.Migrator(c.db, revisions...)
+  return err
+}
+
+// reads the revisions at p
+// a bundle is read from its root, a directory with ReadRevisions and a
+// single file with ReadChangelog so its includes are followed
+// revision paths are relative to the bundle, the directory or the file's
+// directory, so the history is the same however p is written, see
+// drift.DirFileSystem
+func readRevisions(p string) ([]*drift.Revision, error) {
+  lower := strings.ToLower(p)
+  for _, ext := range([]string{".zip", ".tar", ".tar.gz", ".tgz"}) {
+    if strings.HasSuffix(lower, ext) {
+      fs, closer, err := drift.OpenArchive(p)
+      if err != nil {
+        return nil, err
+      }
+      defer closer.Close()
+      return drift.ReadRevisions(".", fs)
+    }
+  }
+  info, err := os.Stat(p)
+  if err != nil {
+    return nil, err
+  }
+  if info.IsDir() {
+    return drift.ReadRevisions(".", drift.DirFileSystem{Root: p})
+  }
+  return drift.ReadChangelog(filepath.Base(p), drift.DirFileSystem{Root: filepath.Dir(p)})
+}
+
+// status -check found pending changesets
+type errPending int
+
+func (e errPending) Error() string { return fmt.Sprintf("%d pending changesets", int(e)) }
+
+func status(c *cli) error {
+  pending, err := c.migrator.Pending()
+  if err != nil {
+    return err
+  }
+  for _, p := range(pending) {
+    fmt.Fprintf(c.out, "PENDING %s::%s\n", p.Revision.Path(), p.Changeset.ID())
+  }
+  fmt.Fprintf(c.out, "%d pending changesets\n", len(pending))
+  if c.check && len(pending) > 0 {
+    return errPending(len(pending))
+  }
+  return nil
+}
+
+func migrate(c *cli) error {
+  summary, err := c.migrator.Migrate()
+  printSummary(c.out, summary)
+  if err != nil {
+    return err
+  }
+  // failonerror:false changesets don't stop the migration but still failed
+  if failed := summary.Count(drift.Failed); failed > 0 {
+    return fmt.Errorf("%d changesets failed", failed)
+  }
+  return nil
+}
+
+func rollback(c *cli) error {
+  var summary drift.Summary
+  var err error
+  if len(c.to) > 0 {
+    summary, err = c.migrator.RollbackTo(c.to)
+  } else {
+    summary, err = c.migrator.Rollback(c.count)
+  }
+  printSummary(c.out, summary)
+  return err
+}
+
+func validate(c *cli) error {
+  if err := c.migrator.Validate(); err != nil {
+    return err
+  }
+  fmt.Fprintf(c.out, "%d revisions are valid\n", len(c.revisions))
+  return nil
+}
+
+func history(c *cli) error {
+  entries, err := c.migrator.History()
+  if err != nil {
+    return err
+  }
+  w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(w, "ORDER\tEXECUTED\tSTATUS\tCHANGESET\tAUTHOR")
+  for _, e := range(entries) {
+    fmt.Fprintf(w, "%d\t%s\t%s\t%s::%s\t%s\n", e.Order, e.Executed.Format("2006-01-02 15:04:05"), e.Status, e.Path, e.ID, e.Author)
+  }
+  return w.Flush()
+}
+
+// nested comments and backslash escapes follow the dialect, as they do when
+// migrating
+func parse(c *cli) error {
+  dbms := c.config.DBMS
+  if len(dbms) == 0 {
+    dbms = c.config.Driver
+  }
+  d := drift.LookupDialect(dbms)
+  var errs drift.ParseErrors
+  count := 0
+  for _, rev := range(c.revisions) {
+    r, err := rev.Changesets()
+    if err != nil {
+      return err
+    }
+    r.SetNestedComments(d.NestedComments)
+    r.SetBackslashEscapes(d.BackslashEscapes)
+    r.SetDefaultAttributes(c.config.Attributes)
+    for {
+      cs, err := r.Next()
+      if err == io.EOF {
+        break
+      }
+      if perrs, ok := err.(drift.ParseErrors); ok {
+        errs = append(errs, perrs...)
+        continue
+      }
+      if err != nil {
+        r.Close()
+        return err
+      }
+      count++
+      fmt.Fprintf(c.out, "%s:%d %s (%d statements)\n", rev.Path(), cs.Line(), cs.ID(), len(cs.Statements()))
+    }
+    r.Close()
+  }
+  if len(errs) > 0 {
+    return errs
+  }
+  fmt.Fprintf(c.out, "%d changesets in %d revisions\n", count, len(c.revisions))
+  return nil
+}
+
+func printSummary(w io.Writer, summary drift.Summary) {
+  if len(summary) > 0 {
+    fmt.Fprintln(w, summary)
+  }
+}
+
+// parse errors are printed with the offending lines
+func printError(w io.Writer, name string, err error) {
+  var perrs drift.ParseErrors
+  if errors.As(err, &perrs) {
+    fmt.Fprintf(w, "drift %s: %s\n", name, perrs.Detail())
+    return
+  }
+  fmt.Fprintf(w, "drift %s: %v\n", name, err)
+}
+
+func usage(w io.Writer) {
+  fmt.Fprintln(w, "usage: drift <command> [flags]\n\ncommands:")
+  for _, c := range(commands) {
+    fmt.Fprintf(w, "  %-9s %s\n", c.name, c.usage)
+  }
+  fmt.Fprintf(w, "\nexit codes: %d ok, %d failed, %d usage, %d pending (status -check), %d bad config\n",
+    exitOK, exitFailed, exitUsage, exitPending, exitConfig)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+  "os"
+  "bytes"
+  "errors"
+  "strings"
+  "testing"
+  "io/ioutil"
+  "archive/zip"
+  "path/filepath"
+)
+
+// runs a command line returning the exit code, stdout and stderr
+func runArgs(args ...string) (int, string, string) {
+  var stdout, stderr bytes.Buffer
+  code := run(args, &stdout, &stderr)
+  return code, stdout.String(), stderr.String()
+}
+
+// writes revisions to a temporary directory
+func revisionDir(t *testing.T, revisions map[string]string) string {
+  dir := t.TempDir()
+  for name, data := range(revisions) {
+    if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return dir
+}
+
+func TestUsage(t *testing.T) {
+  dir := revisionDir(t, nil)
+  for _, value := range([]struct{
+    args   []string
+    code   int
+    stderr string
+  }{
+    {nil, exitUsage, "usage: drift <command>"},
+    {[]string{"help"}, exitOK, ""},
+    {[]string{"upgrade"}, exitUsage, "unknown command 'upgrade'"},
+    {[]string{"parse"}, exitUsage, "-path is required"},
+    {[]string{"parse", "-path", dir, "extra"}, exitUsage, "unexpected argument 'extra'"},
+    {[]string{"parse", "-dsn", "x"}, exitUsage, "flag provided but not defined: -dsn"},
+    {[]string{"migrate", "-path", dir}, exitUsage, "-driver is required"},
+    {[]string{"migrate", "-path", dir, "-driver", "ql"}, exitUsage, "-dsn is required"},
+    {[]string{"status", "-path", dir, "-driver", "nope", "-dsn", "x"}, exitFailed, `unknown driver "nope"`},
+    {[]string{"validate", "-path", filepath.Join(dir, "missing"), "-driver", "nope", "-dsn", "x"}, exitFailed, "no such file or directory"},
+  }) {
+    code, _, stderr := runArgs(value.args...)
+    if code != value.code || !strings.Contains(stderr, value.stderr) {
+      t.Errorf("%v: expected %v '%v' got %v '%v'", value.args, value.code, value.stderr, code, stderr)
+    }
+  }
+}
+
+func TestParse(t *testing.T) {
+  dir := revisionDir(t, map[string]string{
+    "V2.sql":  "--+ changeset id:2\nSELECT 2;",
+    "V10.sql": "--+ changeset id:10\nSELECT 10;\n--+ changeset id:11\nSELECT 11; SELECT 12;",
+    "V1.sql":  "--+ include path:V2.sql\n--+ changeset id:1\nSELECT 1;",
+  })
+  code, stdout, stderr := runArgs("parse", "-path", dir)
+  expected := strings.Join([]string{
+    "V1.sql:3 1 (1 statements)",
+    "V2.sql:2 2 (1 statements)",
+    "V10.sql:2 10 (1 statements)",
+    "V10.sql:4 11 (2 statements)",
+    "4 changesets in 3 revisions\n",
+  }, "\n")
+  if code != exitOK || stdout != expected {
+    t.Errorf("expected %v '%v' got %v '%v' '%v'", exitOK, expected, code, stdout, stderr)
+  }
+
+  // a single file follows its includes
+  code, stdout, _ = runArgs("parse", "-path", filepath.Join(dir, "V1.sql"))
+  if code != exitOK || !strings.HasSuffix(stdout, "2 changesets in 2 revisions\n") {
+    t.Errorf("expected the include to be read got %v '%v'", code, stdout)
+  }
+}
+
+// revisions are recorded by their path from -path, however it's written
+func TestParsePaths(t *testing.T) {
+  root := revisionDir(t, nil)
+  dir := filepath.Join(root, "migrations")
+  if err := os.MkdirAll(filepath.Join(root, "shared"), 0755); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Mkdir(dir, 0755); err != nil {
+    t.Fatal(err)
+  }
+  for name, data := range(map[string]string{
+    "migrations/V1.sql": "--+ include path:../shared/S1.sql\n--+ changeset id:1\nSELECT 1;",
+    "shared/S1.sql":     "--+ changeset id:s1\nSELECT 1;",
+  }) {
+    if err := ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  t.Chdir(root)
+  // a directory is read as is, a file follows its includes
+  dirOutput := "V1.sql:3 1 (1 statements)\n1 changesets in 1 revisions\n"
+  fileOutput := "../shared/S1.sql:2 s1 (1 statements)\nV1.sql:3 1 (1 statements)\n2 changesets in 2 revisions\n"
+  for _, value := range([]struct{
+    path     string
+    expected string
+  }{
+    {"migrations", dirOutput},
+    {"migrations/", dirOutput},
+    {"./migrations", dirOutput},
+    {dir, dirOutput},
+    {dir + "/", dirOutput},
+    {"migrations/V1.sql", fileOutput},
+    {filepath.Join(dir, "V1.sql"), fileOutput},
+  }) {
+    code, stdout, stderr := runArgs("parse", "-path", value.path)
+    if code != exitOK || stdout != value.expected {
+      t.Errorf("%v: expected '%v' got %v '%v' '%v'", value.path, value.expected, code, stdout, stderr)
+    }
+  }
+}
+
+// nested comments and backslash escapes come from -dbms or the driver
+func TestParseDialect(t *testing.T) {
+  dir := revisionDir(t, map[string]string{
+    "V1.sql": "--+ changeset id:1\n/* a /* b */ SELECT 1; */ SELECT 'it\\'s; ok';",
+  })
+  for _, value := range([]struct{
+    args     []string
+    code     int
+    expected string
+  }{
+    {nil, exitFailed, "unterminated string"},
+    {[]string{"-dbms", "postgres"}, exitFailed, "unterminated string"},
+    {[]string{"-dbms", "mysql"}, exitOK, "V1.sql:2 1 (2 statements)"},
+    {[]string{"-driver", "mysql"}, exitOK, "V1.sql:2 1 (2 statements)"},
+    {[]string{"-driver", "mysql", "-dbms", "postgres"}, exitFailed, "unterminated string"},
+  }) {
+    code, stdout, stderr := runArgs(append([]string{"parse", "-path", dir}, value.args...)...)
+    if code != value.code || !strings.Contains(stdout + stderr, value.expected) {
+      t.Errorf("%v: expected %v '%v' got %v '%v' '%v'", value.args, value.code, value.expected, code, stdout, stderr)
+    }
+  }
+
+  dir = revisionDir(t, map[string]string{
+    "V1.sql": "--+ changeset id:1\n/* a /* b */ SELECT 1; */ SELECT 2;",
+  })
+  for dbms, expected := range(map[string]string{
+    "postgres": "V1.sql:2 1 (1 statements)",
+    "mysql":    "V1.sql:2 1 (2 statements)",
+  }) {
+    code, stdout, stderr := runArgs("parse", "-path", dir, "-dbms", dbms)
+    if code != exitOK || !strings.Contains(stdout, expected) {
+      t.Errorf("%s: expected '%v' got %v '%v' '%v'", dbms, expected, code, stdout, stderr)
+    }
+  }
+}
+
+func TestParseErrors(t *testing.T) {
+  dir := revisionDir(t, map[string]string{
+    "V1.sql": "--+ changeset id:1\nSELECT 1;\n--+ changeset author:x\nSELECT 2;\n--+ changeset id:3\nSELECT 3;",
+  })
+  code, stdout, stderr := runArgs("parse", "-path", dir)
+  if code != exitFailed {
+    t.Errorf("expected %v got %v", exitFailed, code)
+  }
+  if !strings.Contains(stdout, ":6 3 (1 statements)") {
+    t.Errorf("expected the changesets after the error to be listed got '%v'", stdout)
+  }
+  if !strings.Contains(stderr, "V1.sql:3:") || !strings.Contains(stderr, "\n--+ changeset author:x\n") {
+    t.Errorf("expected the error with its line got '%v'", stderr)
+  }
+}
+
+func TestParseArchive(t *testing.T) {
+  var buf bytes.Buffer
+  w := zip.NewWriter(&buf)
+  f, _ := w.Create("migrations/V1.sql")
+  f.Write([]byte("--+ changeset id:1\nSELECT 1;"))
+  w.Close()
+  p := filepath.Join(t.TempDir(), "bundle.zip")
+  if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+    t.Fatal(err)
+  }
+  code, stdout, stderr := runArgs("parse", "-path", p)
+  if code != exitOK || stdout != "migrations/V1.sql:2 1 (1 statements)\n1 changesets in 1 revisions\n" {
+    t.Errorf("unexpected output %v '%v' '%v'", code, stdout, stderr)
+  }
+}
+
+func TestConfig(t *testing.T) {
+  dir := revisionDir(t, map[string]string{
+    "V1.sql": "--+ changeset id:1\nSELECT 1; SELECT 2;",
+  })
+  other := revisionDir(t, map[string]string{
+    "V1.sql": "--+ changeset id:1\nSELECT 1;",
+    "V2.sql": "--+ changeset id:2\nSELECT 2;",
+  })
+  config := filepath.Join(t.TempDir(), "drift.toml")
+  data := "path = \"" + dir + "\"\n" +
+    "[profiles.whole]\nattributes.splitstatements = false\n" +
+    "[profiles.secret]\ndsn = \"${DRIFT_TEST_SECRET}\"\n"
+  if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+    t.Fatal(err)
+  }
+  bad := filepath.Join(t.TempDir(), "drift.toml")
+  if err := ioutil.WriteFile(bad, []byte("path = migrations\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, value := range([]struct{
+    args   []string
+    env    map[string]string
+    code   int
+    output string
+  }{
+    // the config file gives the path
+    {[]string{"parse", "-config", config}, nil, exitOK, "V1.sql:2 1 (2 statements)"},
+    {[]string{"parse"}, map[string]string{"DRIFT_CONFIG": config}, exitOK, "V1.sql:2 1 (2 statements)"},
+    // profiles give default attributes
+    {[]string{"parse", "-config", config, "-profile", "whole"}, nil, exitOK, "V1.sql:2 1 (1 statements)"},
+    {[]string{"parse", "-config", config}, map[string]string{"DRIFT_PROFILE": "whole"}, exitOK, "V1.sql:2 1 (1 statements)"},
+    // the environment goes over the file and flags go over both
+    {[]string{"parse", "-config", config}, map[string]string{"DRIFT_PATH": other}, exitOK, "2 changesets in 2 revisions"},
+    {[]string{"parse", "-config", config, "-path", dir}, map[string]string{"DRIFT_PATH": other}, exitOK, "1 changesets in 1 revisions"},
+    {[]string{"parse", "-config", config, "-profile", "staging"}, nil, exitConfig, "unknown profile 'staging'"},
+    {[]string{"parse", "-config", config, "-profile", "secret"}, nil, exitConfig, "variable DRIFT_TEST_SECRET is not set"},
+    {[]string{"status", "-config", config, "-profile", "secret"}, map[string]string{"DRIFT_TEST_SECRET": "x"}, exitUsage, "-driver is required"},
+    {[]string{"parse", "-config", filepath.Join(dir, "missing.toml")}, nil, exitConfig, "no such file or directory"},
+    {[]string{"parse", "-config", bad}, nil, exitConfig, "drift.toml:1: invalid value 'migrations', strings have to be quoted"},
+  }) {
+    for name, v := range(value.env) {
+      t.Setenv(name, v)
+    }
+    code, stdout, stderr := runArgs(value.args...)
+    if code != value.code || !strings.Contains(stdout + stderr, value.output) {
+      t.Errorf("%v %v: expected %v '%v' got %v '%v' '%v'", value.args, value.env, value.code, value.output, code, stdout, stderr)
+    }
+    for name := range(value.env) {
+      os.Unsetenv(name)
+    }
+  }
+}
+
+// a config in the working directory is read when none is given
+func TestConfigDefaultFile(t *testing.T) {
+  dir := revisionDir(t, map[string]string{
+    "V1.sql":     "--+ changeset id:1\nSELECT 1;",
+    "drift.toml": "path = \".\"\n",
+  })
+  t.Chdir(dir)
+  code, stdout, stderr := runArgs("parse")
+  if code != exitOK || stdout != "V1.sql:2 1 (1 statements)\n1 changesets in 1 revisions\n" {
+    t.Errorf("unexpected output %v '%v' '%v'", code, stdout, stderr)
+  }
+}
+
+// the database commands, their output and exit codes
+func TestCommands(t *testing.T) {
+  dir := revisionDir(t, map[string]string{
+    "V1.sql": "--+ changeset id:1\n--+ rollback DROP TABLE a;\nCREATE TABLE a (id int);",
+    "V2.sql": "--+ changeset id:2 failonerror:false\n--+ rollback DROP TABLE b;\nCREATE TABLE b (id boom);",
+  })
+  dsn, fake := newFakeDB(t)
+  fake.fail["boom"] = errors.New("boom")
+  db := []string{"-driver", "fake", "-dsn", dsn, "-dbms", "ql", "-path", dir}
+  for _, value := range([]struct{
+    args   []string
+    code   int
+    output []string   // lines of stdout and stderr in order
+  }{
+    {[]string{"status"}, exitOK, []string{"PENDING V1.sql::1", "PENDING V2.sql::2", "2 pending changesets"}},
+    {[]string{"status", "-check"}, exitPending, []string{"PENDING V1.sql::1", "2 pending changesets"}},
+    {[]string{"history"}, exitOK, []string{"ORDER  EXECUTED  STATUS  CHANGESET  AUTHOR"}},
+    // a failonerror:false changeset doesn't stop the migration but still fails
+    {[]string{"migrate"}, exitFailed, []string{"EXECUTED V1.sql::1 (", "FAILED V2.sql::2 (", "boom", "drift migrate: 1 changesets failed"}},
+    {[]string{"status", "-check"}, exitPending, []string{"PENDING V2.sql::2", "1 pending changesets"}},
+    {[]string{"history"}, exitOK, []string{"EXECUTED", "V1.sql::1", "FAILED", "V2.sql::2"}},
+    {[]string{"validate"}, exitOK, []string{"2 revisions are valid"}},
+    {[]string{"rollback"}, exitOK, []string{"ROLLED BACK V1.sql::1 ("}},
+    {[]string{"rollback", "-to", "missing"}, exitFailed, []string{"drift rollback: changeset missing has not been applied"}},
+  }) {
+    code, stdout, stderr := runArgs(append(value.args, db...)...)
+    output := stdout + stderr
+    rest := output
+    for _, line := range(value.output) {
+      i := strings.Index(rest, line)
+      if i < 0 {
+        t.Errorf("%v: expected '%v' in '%v'", value.args, line, output)
+        break
+      }
+      rest = rest[i + len(line):]
+    }
+    if code != value.code {
+      t.Errorf("%v: expected exit %v got %v '%v'", value.args, value.code, code, output)
+    }
+  }
+  if statements := strings.Join(fake.statements(), "|"); statements != "CREATE TABLE a (id int);|DROP TABLE a;" {
+    t.Errorf("unexpected statements %v", statements)
+  }
+
+  // editing an applied changeset fails validation
+  delete(fake.fail, "boom")
+  if code, _, _ := runArgs(append([]string{"migrate"}, db...)...); code != exitOK {
+    t.Fatalf("expected the migration to succeed got %v", code)
+  }
+  ioutil.WriteFile(filepath.Join(dir, "V1.sql"), []byte("--+ changeset id:1\nCREATE TABLE a (id bigint);"), 0644)
+  code, _, stderr := runArgs(append([]string{"validate"}, db...)...)
+  if code != exitFailed || !strings.Contains(stderr, "V1.sql: changeset 1 has been edited") {
+    t.Errorf("expected the edit to fail validation got %v '%v'", code, stderr)
+  }
+}
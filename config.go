@@ -0,0 +1,523 @@
+package drift
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "sort"
+  "strings"
+  "strconv"
+  "database/sql"
+  "io/ioutil"
+)
+
+// the config files the drift command looks for when it isn't given one
+var DefaultConfigFiles = []string{"drift.toml"}
+
+// A Config holds the settings of a migration so they don't have to be given
+// every time, it's read from a drift.toml file
+// profiles override the top level settings for an environment, values can
+// use ${VAR} (or ${VAR:-default}) to pull secrets from the environment
+// e.g. driver = "postgres"
+//      path = "migrations"
+//      contexts = ["dev"]
+//      [attributes]
+//      author = "ops"
+//      [profiles.prod]
+//      dsn = "postgres://app:${DB_PASSWORD}@db/app"
+//      contexts = ["prod"]
+type Config struct {
+  Driver     string              // database/sql driver name
+  DSN        string              // data source name passed to the driver
+  DBMS       string              // database the changesets target, the driver if empty
+  Path       string              // revision file, directory or bundle
+  Table      string              // history table name
+  Contexts   []string            // see Migrator.SetContexts
+  Attributes map[string]string   // see Migrator.SetDefaultAttributes
+  Profiles   map[string]*Config  // settings per environment
+}
+
+// Reads a .toml config file
+// only the part of toml a config needs is understood: tables, strings,
+// numbers, booleans and lists of them on one line, see the config format
+// variables aren't expanded until a profile is picked, see Resolve
+func ReadConfig(name string, fs FileSystem) (*Config, error) {
+  f, err := fs.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  data, err := ioutil.ReadAll(f)
+  if err != nil {
+    return nil, err
+  }
+  if strings.ToLower(path.Ext(name)) != ".toml" {
+    return nil, fmt.Errorf("%s is not a .toml config", name)
+  }
+  tree, err := parseConfig(name, string(data))
+  if err != nil {
+    return nil, err
+  }
+  c, err := decodeConfig(tree, true)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", name, err)
+  }
+  return c, nil
+}
+
+// builds a config from the parsed file, profiles can't hold profiles
+func decodeConfig(tree map[string]interface{}, top bool) (*Config, error) {
+  c := &Config{}
+  for _, key := range(sortedTreeKeys(tree)) {
+    value := tree[key]
+    var err error
+    switch key {
+    case "driver":
+      c.Driver, err = configString(key, value)
+    case "dsn":
+      c.DSN, err = configString(key, value)
+    case "dbms":
+      c.DBMS, err = configString(key, value)
+    case "path":
+      c.Path, err = configString(key, value)
+    case "table":
+      c.Table, err = configString(key, value)
+    case "contexts":
+      c.Contexts, err = configList(key, value)
+    case "attributes":
+      c.Attributes, err = configMap(key, value)
+    case "profiles":
+      profiles, ok := value.(map[string]interface{})
+      if !top || !ok {
+        return nil, fmt.Errorf("'%s' can't be set here", key)
+      }
+      c.Profiles = make(map[string]*Config)
+      for name, profile := range(profiles) {
+        tree, ok := profile.(map[string]interface{})
+        if !ok {
+          return nil, fmt.Errorf("profile '%s' isn't a table", name)
+        }
+        if c.Profiles[name], err = decodeConfig(tree, false); err != nil {
+          return nil, fmt.Errorf("profile '%s': %v", name, err)
+        }
+      }
+    default:
+      return nil, fmt.Errorf("unknown setting '%s'", key)
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+  return c, nil
+}
+
+func configString(key string, value interface{}) (string, error) {
+  s, ok := value.(string)
+  if !ok {
+    return "", fmt.Errorf("'%s' should be a single value", key)
+  }
+  return s, nil
+}
+
+// lists can also be given as a comma separated string
+func configList(key string, value interface{}) ([]string, error) {
+  switch v := value.(type) {
+  case string:
+    return splitList(v), nil
+  case []string:
+    return v, nil
+  }
+  return nil, fmt.Errorf("'%s' should be a list", key)
+}
+
+func configMap(key string, value interface{}) (map[string]string, error) {
+  tree, ok := value.(map[string]interface{})
+  if !ok {
+    return nil, fmt.Errorf("'%s' should be a table", key)
+  }
+  m := make(map[string]string)
+  for k, v := range(tree) {
+    s, ok := v.(string)
+    if !ok {
+      return nil, fmt.Errorf("'%s.%s' should be a single value", key, k)
+    }
+    m[k] = s
+  }
+  return m, nil
+}
+
+// the settings of a profile over the top level settings with every ${VAR}
+// expanded by lookup, os.LookupEnv if nil
+// an empty profile gives the top level settings, naming a profile that isn't
+// in the config is an error
+// attributes are merged, a profile's attribute replaces the same one at the
+// top level
+func (c *Config) Resolve(profile string, lookup func(string) (string, bool)) (*Config, error) {
+  if lookup == nil {
+    lookup = os.LookupEnv
+  }
+  r := &Config{
+    Driver:     c.Driver,
+    DSN:        c.DSN,
+    DBMS:       c.DBMS,
+    Path:       c.Path,
+    Table:      c.Table,
+    Contexts:   c.Contexts,
+    Attributes: make(map[string]string),
+  }
+  for k, v := range(c.Attributes) {
+    r.Attributes[k] = v
+  }
+  if len(profile) > 0 {
+    p, ok := c.Profiles[profile]
+    if !ok {
+      return nil, fmt.Errorf("unknown profile '%s'", profile)
+    }
+    r.Merge(p)
+  }
+
+  var err error
+  expand := func(s *string) {
+    if err == nil {
+      *s, err = expandVariables(*s, lookup)
+    }
+  }
+  for _, s := range([]*string{&r.Driver, &r.DSN, &r.DBMS, &r.Path, &r.Table}) {
+    expand(s)
+  }
+  r.Contexts = append([]string(nil), r.Contexts...)
+  for i := range(r.Contexts) {
+    expand(&r.Contexts[i])
+  }
+  for k, v := range(r.Attributes) {
+    expand(&v)
+    r.Attributes[k] = v
+  }
+  if err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+// sets everything o sets over c, attributes are merged
+// this is how settings from the environment and the command line take
+// precedence over the config file
+func (c *Config) Merge(o *Config) {
+  for _, s := range([]struct{ to *string; from string }{
+    {&c.Driver, o.Driver},
+    {&c.DSN, o.DSN},
+    {&c.DBMS, o.DBMS},
+    {&c.Path, o.Path},
+    {&c.Table, o.Table},
+  }) {
+    if len(s.from) > 0 {
+      *s.to = s.from
+    }
+  }
+  if len(o.Contexts) > 0 {
+    c.Contexts = o.Contexts
+  }
+  if len(o.Attributes) > 0 && c.Attributes == nil {
+    c.Attributes = make(map[string]string)
+  }
+  for k, v := range(o.Attributes) {
+    c.Attributes[k] = v
+  }
+}
+
+// the settings given by DRIFT_DRIVER, DRIFT_DSN, DRIFT_DBMS, DRIFT_PATH,
+// DRIFT_TABLE and DRIFT_CONTEXTS, looked up with lookup, os.LookupEnv if nil
+func EnvConfig(lookup func(string) (string, bool)) *Config {
+  if lookup == nil {
+    lookup = os.LookupEnv
+  }
+  get := func(name string) string {
+    value, _ := lookup("DRIFT_" + name)
+    return value
+  }
+  return &Config{
+    Driver:   get("DRIVER"),
+    DSN:      get("DSN"),
+    DBMS:     get("DBMS"),
+    Path:     get("PATH"),
+    Table:    get("TABLE"),
+    Contexts: splitList(get("CONTEXTS")),
+  }
+}
+
+// creates a Migrator for the revisions with the config's history table,
+// contexts and default attributes
+func (c *Config) Migrator(db *sql.DB, revisions ...*Revision) (*Migrator, error) {
+  dbms := c.DBMS
+  if len(dbms) == 0 {
+    dbms = c.Driver
+  }
+  m := NewMigrator(db, dbms, revisions...)
+  if len(c.Table) > 0 {
+    m.SetHistoryTable(c.Table)
+  }
+  m.SetContexts(c.Contexts...)
+  if err := m.SetDefaultAttributes(c.Attributes); err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+// replaces ${VAR} and ${VAR:-default} with the value of VAR, $$ is a $
+// variables that aren't set and have no default are an error
+func expandVariables(s string, lookup func(string) (string, bool)) (string, error) {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    if s[i] != '$' || i + 1 == len(s) {
+      b.WriteByte(s[i])
+      continue
+    }
+    switch s[i + 1] {
+    case '$':
+      b.WriteByte('$')
+      i++
+      continue
+    case '{':
+    default:
+      b.WriteByte(s[i])
+      continue
+    }
+    end := strings.IndexByte(s[i:], '}')
+    if end < 0 {
+      return "", fmt.Errorf("unterminated variable in '%s'", s)
+    }
+    name, fallback, hasDefault := strings.Cut(s[i + 2:i + end], ":-")
+    value, ok := lookup(name)
+    switch {
+    case ok:
+      b.WriteString(value)
+    case hasDefault:
+      b.WriteString(fallback)
+    default:
+      return "", fmt.Errorf("variable %s is not set", name)
+    }
+    i += end
+  }
+  return b.String(), nil
+}
+
+func sortedTreeKeys(tree map[string]interface{}) []string {
+  keys := make([]string, 0, len(tree))
+  for key := range(tree) {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// ----------------------------------------------------------------------------
+// the config format
+// ----------------------------------------------------------------------------
+// configs are written in a small part of toml, only what a config needs:
+//   # comments, on their own or after a value
+//   [table] and [dotted.table] headers
+//   key = value, keys are bare (letters, digits, _ and -) and can be dotted
+//   values are "strings" with \ escapes, 'strings' without, true, false,
+//   numbers and ["lists", "of", "them"] on one line
+// anything else is an error, rather than being half understood
+// files are parsed in to maps of strings, lists of strings and more maps
+
+// an error at a line of a config file
+func configError(name string, lineno int, format string, args ...interface{}) error {
+  return fmt.Errorf("%s:%d: %s", name, lineno, fmt.Sprintf(format, args...))
+}
+
+// sets a dotted key in a tree, making the tables along the way
+func setTreeKey(tree map[string]interface{}, keys []string, value interface{}) error {
+  for _, key := range(keys[:len(keys) - 1]) {
+    next, ok := tree[key]
+    if !ok {
+      next = make(map[string]interface{})
+      tree[key] = next
+    }
+    if tree, ok = next.(map[string]interface{}); !ok {
+      return fmt.Errorf("'%s' is already a value", key)
+    }
+  }
+  key := keys[len(keys) - 1]
+  if _, ok := tree[key]; ok {
+    return fmt.Errorf("'%s' is given more than once", key)
+  }
+  tree[key] = value
+  return nil
+}
+
+// splits a dotted key of bare keys
+func splitKey(key string) ([]string, error) {
+  keys := strings.Split(key, ".")
+  for i, part := range(keys) {
+    keys[i] = strings.TrimSpace(part)
+    if len(keys[i]) == 0 || strings.TrimFunc(keys[i], isKeyRune) != "" {
+      return nil, fmt.Errorf("invalid key '%s'", strings.TrimSpace(key))
+    }
+  }
+  return keys, nil
+}
+
+// test if a rune can be part of a bare key
+func isKeyRune(r rune) bool {
+  return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
+
+// reads a quoted string off the front of s returning the rest
+// "double" quotes take \ escapes, 'single' quotes don't
+func unquote(s string) (string, string, error) {
+  quote := s[0]
+  for i := 1; i < len(s); i++ {
+    switch {
+    case s[i] == '\\' && quote == '"':
+      i++
+    case s[i] == quote:
+      if quote == '\'' {
+        return s[1:i], s[i + 1:], nil
+      }
+      value, err := strconv.Unquote(s[:i + 1])
+      return value, s[i + 1:], err
+    }
+  }
+  return "", "", fmt.Errorf("unterminated string %s", s)
+}
+
+// strips a # comment, #s in quotes don't count
+func stripComment(line string) string {
+  var quote byte
+  for i := 0; i < len(line); i++ {
+    switch c := line[i]; {
+    case quote == '"' && c == '\\':
+      i++
+    case quote != 0:
+      if c == quote {
+        quote = 0
+      }
+    case c == '"' || c == '\'':
+      quote = c
+    case c == '#':
+      return line[:i]
+    }
+  }
+  return line
+}
+
+// parses a single value: a string, boolean or number, which are kept as
+// they're written
+func parseScalar(s string) (string, string, error) {
+  if len(s) == 0 {
+    return "", "", fmt.Errorf("missing value")
+  }
+  if s[0] == '"' || s[0] == '\'' {
+    return unquote(s)
+  }
+  i := strings.IndexAny(s, ", \t]")
+  if i < 0 {
+    i = len(s)
+  }
+  value := s[:i]
+  if !isLiteral(value) {
+    return "", "", fmt.Errorf("invalid value '%s', strings have to be quoted", value)
+  }
+  return value, s[i:], nil
+}
+
+// parses a scalar or [a, b] list value
+func parseValue(s string) (interface{}, error) {
+  s = strings.TrimSpace(s)
+  switch {
+  case strings.HasPrefix(s, "{"):
+    return nil, fmt.Errorf("inline tables aren't supported, use a [table]")
+  case s == "[" || strings.HasPrefix(s, "[") && !strings.HasSuffix(s, "]"):
+    return nil, fmt.Errorf("unterminated list %s, lists have to be on one line", s)
+  case strings.HasPrefix(s, "["):
+    list := []string{}
+    rest := strings.TrimSpace(s[1:len(s) - 1])
+    for len(rest) > 0 {
+      item, r, err := parseScalar(rest)
+      if err != nil {
+        return nil, err
+      }
+      list = append(list, item)
+      rest = strings.TrimSpace(r)
+      if len(rest) > 0 {
+        if rest[0] != ',' {
+          return nil, fmt.Errorf("expected , in list %s", s)
+        }
+        rest = strings.TrimSpace(rest[1:])
+      }
+    }
+    return list, nil
+  }
+  value, rest, err := parseScalar(s)
+  if err != nil {
+    return nil, err
+  }
+  if rest = strings.TrimSpace(rest); len(rest) > 0 {
+    return nil, fmt.Errorf("unexpected '%s' after value", rest)
+  }
+  return value, nil
+}
+
+// whether s is a boolean or a number
+func isLiteral(s string) bool {
+  if s == "true" || s == "false" {
+    return true
+  }
+  if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+    return true
+  }
+  _, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+  return err == nil
+}
+
+// parses a config, see the config format above
+func parseConfig(name string, data string) (map[string]interface{}, error) {
+  tree := make(map[string]interface{})
+  table := tree
+  for i, line := range(strings.Split(data, "\n")) {
+    lineno := i + 1
+    line = strings.TrimSpace(stripComment(line))
+    if len(line) == 0 {
+      continue
+    }
+    if line[0] == '[' {
+      if line[len(line) - 1] != ']' || strings.HasPrefix(line, "[[") {
+        return nil, configError(name, lineno, "invalid table '%s'", line)
+      }
+      keys, err := splitKey(line[1:len(line) - 1])
+      if err != nil {
+        return nil, configError(name, lineno, "%v", err)
+      }
+      table = tree
+      for _, key := range(keys) {
+        next, ok := table[key]
+        if !ok {
+          next = make(map[string]interface{})
+          table[key] = next
+        }
+        if table, ok = next.(map[string]interface{}); !ok {
+          return nil, configError(name, lineno, "'%s' is already a value", key)
+        }
+      }
+      continue
+    }
+    eq := strings.IndexByte(line, '=')
+    if eq < 0 {
+      return nil, configError(name, lineno, "expected key = value got '%s'", line)
+    }
+    keys, err := splitKey(line[:eq])
+    if err != nil {
+      return nil, configError(name, lineno, "%v", err)
+    }
+    value, err := parseValue(line[eq + 1:])
+    if err != nil {
+      return nil, configError(name, lineno, "%v", err)
+    }
+    if err := setTreeKey(table, keys, value); err != nil {
+      return nil, configError(name, lineno, "%v", err)
+    }
+  }
+  return tree, nil
+}
@@ -0,0 +1,189 @@
+package drift
+
+import (
+  "strings"
+  "testing"
+)
+
+var configTOML = `# shared settings
+driver = "postgres"
+path = 'migrations'   # relative to the working directory
+contexts = ["dev", "test"]
+
+[attributes]
+author = "ops"
+failonerror = false
+
+[profiles.prod]
+dsn = "postgres://app:${DB_PASSWORD}@db/app?sslmode=${SSLMODE:-require}"
+contexts = "prod"
+table = "changelog"
+
+[profiles.prod.attributes]
+failonerror = true
+`
+
+// an environment of variables
+func lookupIn(env map[string]string) func(string) (string, bool) {
+  return func(name string) (string, bool) {
+    value, ok := env[name]
+    return value, ok
+  }
+}
+
+func TestReadConfig(t *testing.T) {
+  fs := NewMemFS()
+  fs.WriteFile("drift.toml", []byte(configTOML), 0644)
+  env := lookupIn(map[string]string{"DB_PASSWORD": "secret"})
+  c, err := ReadConfig("drift.toml", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  base, err := c.Resolve("", env)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if base.Driver != "postgres" || base.Path != "migrations" || len(base.DSN) > 0 ||
+    strings.Join(base.Contexts, ",") != "dev,test" ||
+    base.Attributes["author"] != "ops" || base.Attributes["failonerror"] != "false" {
+    t.Errorf("unexpected settings %+v", base)
+  }
+
+  prod, err := c.Resolve("prod", env)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if prod.Driver != "postgres" || prod.DSN != "postgres://app:secret@db/app?sslmode=require" ||
+    prod.Table != "changelog" || strings.Join(prod.Contexts, ",") != "prod" ||
+    prod.Attributes["author"] != "ops" || prod.Attributes["failonerror"] != "true" {
+    t.Errorf("unexpected settings %+v", prod)
+  }
+  // resolving doesn't change the config
+  if c.Attributes["failonerror"] != "false" || strings.Contains(c.Profiles["prod"].DSN, "secret") {
+    t.Errorf("resolving changed the config %+v", c)
+  }
+
+  if _, err := c.Resolve("prod", lookupIn(nil)); err == nil || err.Error() != "variable DB_PASSWORD is not set" {
+    t.Errorf("expected a missing variable to error got %v", err)
+  }
+  if _, err := c.Resolve("staging", env); err == nil || err.Error() != "unknown profile 'staging'" {
+    t.Errorf("expected an unknown profile to error got %v", err)
+  }
+}
+
+func TestReadConfigBad(t *testing.T) {
+  for _, value := range([]struct{
+    name     string
+    data     string
+    expected string
+  }{
+    {"drift.toml", "driver = \"postgres\"\nhost = \"db\"", "drift.toml: unknown setting 'host'"},
+    {"drift.toml", "driver postgres", "drift.toml:1: expected key = value got 'driver postgres'"},
+    {"drift.toml", "driver = \"postgres", "drift.toml:1: unterminated string \"postgres"},
+    {"drift.toml", "driver = \"a\"\ndriver = \"b\"", "drift.toml:2: 'driver' is given more than once"},
+    {"drift.toml", "contexts = [dev, test", "drift.toml:1: unterminated list [dev, test, lists have to be on one line"},
+    {"drift.toml", "contexts = [\n  \"dev\",\n]", "drift.toml:1: unterminated list [, lists have to be on one line"},
+    {"drift.toml", "attributes = { author = \"ops\" }", "drift.toml:1: inline tables aren't supported, use a [table]"},
+    {"drift.toml", "[[profiles]]\ndsn = \"x\"", "drift.toml:1: invalid table '[[profiles]]'"},
+    {"drift.toml", "\"driver\" = \"ql\"", "drift.toml:1: invalid key '\"driver\"'"},
+    {"drift.toml", "dsn = \"\"\"x\"\"\"", "drift.toml:1: unexpected '\"x\"\"\"' after value"},
+    {"drift.toml", "dsn = postgres://db/app", "drift.toml:1: invalid value 'postgres://db/app', strings have to be quoted"},
+    {"drift.toml", "contexts = [\"dev\", test]", "drift.toml:1: invalid value 'test', strings have to be quoted"},
+    {"drift.toml", "driver = [\"a\"]", "drift.toml: 'driver' should be a single value"},
+    {"drift.toml", "[profiles.prod.profiles.dev]\ndsn = \"x\"", "drift.toml: profile 'prod': 'profiles' can't be set here"},
+    {"drift.toml", "[attributes]\nauthor = [\"a\"]", "drift.toml: 'attributes.author' should be a single value"},
+    {"drift.yaml", "driver: postgres", "drift.yaml is not a .toml config"},
+  }) {
+    fs := NewMemFS()
+    fs.WriteFile(value.name, []byte(value.data), 0644)
+    _, err := ReadConfig(value.name, fs)
+    if err == nil || err.Error() != value.expected {
+      t.Errorf("expected '%v' got '%v'", value.expected, err)
+    }
+  }
+}
+
+// strings have to be quoted, #s in them aren't comments, booleans and
+// numbers are taken as they're written
+func TestReadConfigValues(t *testing.T) {
+  for _, data := range([]string{
+    "dsn = 'postgres://app:p#ss@db/app'# the database\n[attributes]\nauthor = \"O'Brien#1\" # quoted\nretries = 3\nratio = 1.5\n",
+    "dsn = \"postgres://app:p\\u0023ss@db/app\"\nattributes.author = \"O'Brien#1\"\nattributes.retries = 3 # dotted\nattributes.ratio = 1.5",
+  }) {
+    fs := NewMemFS()
+    fs.WriteFile("drift.toml", []byte(data), 0644)
+    c, err := ReadConfig("drift.toml", fs)
+    if err != nil {
+      t.Errorf("unexpected error %v", err)
+      continue
+    }
+    if c.DSN != "postgres://app:p#ss@db/app" || c.Attributes["author"] != "O'Brien#1" ||
+      c.Attributes["retries"] != "3" || c.Attributes["ratio"] != "1.5" {
+      t.Errorf("unexpected settings %+v", c)
+    }
+  }
+}
+
+func TestConfigMerge(t *testing.T) {
+  c := &Config{Driver: "postgres", DSN: "file", Contexts: []string{"dev"}, Attributes: map[string]string{"author": "ops"}}
+  env := EnvConfig(lookupIn(map[string]string{"DRIFT_DSN": "env", "DRIFT_CONTEXTS": "test, prod"}))
+  c.Merge(env)
+  c.Merge(&Config{Path: "flags", Attributes: map[string]string{"runonchange": "true"}})
+  if c.Driver != "postgres" || c.DSN != "env" || c.Path != "flags" || strings.Join(c.Contexts, ",") != "test,prod" ||
+    c.Attributes["author"] != "ops" || c.Attributes["runonchange"] != "true" {
+    t.Errorf("unexpected settings %+v", c)
+  }
+}
+
+func TestExpandVariables(t *testing.T) {
+  env := lookupIn(map[string]string{"USER": "app", "EMPTY": ""})
+  for _, value := range([]struct{
+    s        string
+    expected string
+    err      string
+  }{
+    {"plain", "plain", ""},
+    {"${USER}@${HOST:-localhost}", "app@localhost", ""},
+    {"${EMPTY:-x}", "", ""},
+    {"$$USER costs $5", "$USER costs $5", ""},
+    {"${HOST}", "", "variable HOST is not set"},
+    {"${USER", "", "unterminated variable in '${USER'"},
+  }) {
+    s, err := expandVariables(value.s, env)
+    if len(value.err) > 0 {
+      if err == nil || err.Error() != value.err {
+        t.Errorf("expected '%v' got '%v'", value.err, err)
+      }
+      continue
+    }
+    if err != nil || s != value.expected {
+      t.Errorf("expected '%v' got '%v' %v", value.expected, s, err)
+    }
+  }
+}
+
+func TestConfigMigrator(t *testing.T) {
+  db, fake := newFakeDB(t)
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:seed context:dev
+INSERT INTO a VALUES (1);`), path: "/tmp/1.sql"}
+  c := &Config{Driver: "ql", Table: fake.table, Contexts: []string{"prod"}, Attributes: map[string]string{"author": "ops"}}
+  m, err := c.Migrator(db, rev)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := m.Migrate(); err != nil {
+    t.Fatal(err)
+  }
+  entries, _ := m.History()
+  if len(entries) != 1 || entries[0].Author != "ops" {
+    t.Errorf("unexpected entries %+v", entries)
+  }
+
+  c.Attributes["runalways"] = "often"
+  if _, err := c.Migrator(db, rev); err == nil {
+    t.Errorf("expected bad attributes to error")
+  }
+}
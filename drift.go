@@ -2,25 +2,105 @@
 package drift
 
 import (
-  "log"
+  "fmt"
+  "path"
+  "sort"
+  "bytes"
+  "strings"
   "io/ioutil"
 )
 
-type revision struct {
+// A Revision is a migration file read in from a filesystem
+// revisions from OpenRevision aren't read in, they're streamed from the
+// filesystem whenever their changesets are parsed
+type Revision struct {
   data  []byte
   path  string
+  fs    FileSystem   // the filesystem a streamed revision is opened from
 }
 
-type changeset struct {
-  headers string
-  sql     string
+// the path the revision was read from
+func (r *Revision) Path() string { return r.path }
+// the raw contents of the revision, nil if the revision is streamed
+func (r *Revision) Data() []byte { return r.data }
+
+// returns a reader over the revision's changesets, which must be closed
+// streamed revisions are opened here and read as the changesets are
+func (r *Revision) Changesets() (*ChangesetReader, error) {
+  if r.fs == nil {
+    cr := NewChangesetReader(r.path, bytes.NewReader(r.data))
+    cr.p.data = r.data
+    return cr, nil
+  }
+  f, err := r.fs.Open(r.path)
+  if err != nil {
+    return nil, err
+  }
+  cr := NewChangesetReader(r.path, f)
+  cr.closer = f
+  return cr, nil
 }
 
-// Reads a file from a path and parses the file into a revision struct
-// the filesystem argument represents a generic filesystem
+// A Changeset is a single '--+ changeset' section of a revision
+type Changeset struct {
+  header   changesetHeader   // the parsed '--+ changeset' line
+  headers  []string          // the raw '--+' lines following the changeset line
+  sql      string
+  line     int               // the line of the revision the sql starts on
+  rollback string            // sql that undoes the changeset
+
+  delimiter  string          // what the statements are split on
+  statements []string        // the sql split on the delimiter
+  rollbacks  []string        // the rollback sql split on the delimiter
+
+  preconditions []Precondition
+  onFail        OnFail
+  nested        bool   // parsed with nested block comments
+  backslash     bool   // parsed with backslash escapes in quotes
+}
+
+func (c *Changeset) ID() string { return c.header.id }
+func (c *Changeset) Author() string { return c.header.author }
+// the databases the changeset runs against, empty means all of them
+func (c *Changeset) DBMS() []string { return c.header.dbms }
+// the contexts the changeset runs in, from its context attribute, empty means
+// all of them, see Migrator.SetContexts
+func (c *Changeset) Contexts() []string { return splitList(c.header.attributes["context"]) }
+func (c *Changeset) RunAlways() bool { return c.header.runAlways }
+func (c *Changeset) RunOnChange() bool { return c.header.runOnChange }
+func (c *Changeset) FailOnError() bool { return c.header.failOnError }
+// false if the sql runs as a single statement
+func (c *Changeset) SplitStatements() bool { return c.header.splitStatements }
+// what the sql is split in to statements on, ; unless the changeset says
+func (c *Changeset) Delimiter() string { return c.delimiter }
+// any header attribute drift doesn't know about
+func (c *Changeset) Attribute(key string) (string, bool) {
+  value, ok := c.header.attributes[strings.ToLower(key)]
+  return value, ok
+}
+// the raw '--+' header lines following the changeset header
+func (c *Changeset) Headers() []string { return c.headers }
+// the sql body of the changeset, as written in the revision
+func (c *Changeset) SQL() string { return c.sql }
+// the line of the revision the sql starts on, lines within the sql count on
+// from here
+func (c *Changeset) Line() int { return c.line }
+// the statements of the sql in the order they run, see splitStatements
+func (c *Changeset) Statements() []string { return c.statements }
+// the sql that undoes the changeset, empty if it can't be rolled back
+func (c *Changeset) Rollback() string { return c.rollback }
+// the statements of the rollback sql in the order they run
+func (c *Changeset) RollbackStatements() []string { return c.rollbacks }
+// checks that have to pass before the changeset runs
+func (c *Changeset) Preconditions() []Precondition { return c.preconditions }
+// what happens when a precondition fails, OnFailHalt unless given
+func (c *Changeset) OnFail() OnFail { return c.onFail }
+
+// Reads a file from a path and parses the file into a Revision
+// the FileSystem argument represents a generic filesystem
 // OSFileSystem is an implemention of the local filesystem
 // this can be used by ReadRevision('mypath', OSFileSystem{})
-func ReadRevision(path string, fs filesystem) (*revision, error){
+func ReadRevision(path string, fs FileSystem) (*Revision, error){
   f, err := fs.Open(path)
   if err != nil {
     return nil, err
@@ -30,19 +110,149 @@ func ReadRevision(path string, fs filesystem) (*revision, error){
   if err != nil {
     return nil, err
   }
-  return &revision{out, path}, nil
+  return &Revision{data: out, path: path}, nil
 }
 
-// parses the changesets out of a revision file
-func ParseChangesets(rev *revision) ([]changeset, error){
-  s := NewScanner(rev.data)
-  for s.HasMoreTokens() {
-    tok, err := s.NextToken()
+// Opens a revision without reading it in
+// the file is streamed from the filesystem each time its changesets are
+// parsed, so large revisions never have to be held in memory
+// e.g. OpenRevision('mypath', OSFileSystem{})
+func OpenRevision(path string, fs FileSystem) (*Revision, error) {
+  info, err := fs.Stat(path)
+  if err != nil {
+    return nil, err
+  }
+  if info.IsDir() {
+    return nil, fmt.Errorf("%s is a directory", path)
+  }
+  return &Revision{path: path, fs: fs}, nil
+}
+
+// the revision patterns ReadRevisions uses when it isn't given any
+var DefaultRevisionPatterns = []string{"*.sql"}
+
+// Reads every revision under a directory in the order they should be applied
+// subdirectories are read too, a file is a revision if its name matches one
+// of the glob patterns (*.sql unless given)
+// names are sorted naturally so numbers in them count as numbers, V2__b.sql
+// comes before V10__a.sql, and a subdirectory is read where its name sorts
+// e.g. ReadRevisions('migrations', OSFileSystem{}, '*.sql')
+func ReadRevisions(dir string, fs FileSystem, patterns ...string) ([]*Revision, error) {
+  if len(patterns) == 0 {
+    patterns = DefaultRevisionPatterns
+  }
+  for _, pattern := range(patterns) {
+    if _, err := path.Match(pattern, ""); err != nil {
+      return nil, fmt.Errorf("invalid revision pattern '%s': %v", pattern, err)
+    }
+  }
+  paths, err := findRevisions(dir, fs, patterns)
+  if err != nil {
+    return nil, err
+  }
+  var revisions []*Revision
+  for _, p := range(paths) {
+    rev, err := ReadRevision(p, fs)
     if err != nil {
-      log.Println(err)
-    } else {
-      log.Println(string(tok.runes), " : ", s.offset)
+      return nil, err
+    }
+    revisions = append(revisions, rev)
+  }
+  return revisions, nil
+}
+
+// the paths of the revisions under dir in order
+func findRevisions(dir string, fs FileSystem, patterns []string) ([]string, error) {
+  infos, err := fs.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+  sort.SliceStable(infos, func(i, j int) bool {
+    return naturalLess(infos[i].Name(), infos[j].Name())
+  })
+
+  var paths []string
+  for _, info := range(infos) {
+    p := path.Join(dir, info.Name())
+    if info.IsDir() {
+      found, err := findRevisions(p, fs, patterns)
+      if err != nil {
+        return nil, err
+      }
+      paths = append(paths, found...)
+      continue
     }
+    if matchAny(patterns, info.Name()) {
+      paths = append(paths, p)
+    }
+  }
+  return paths, nil
+}
+
+// test if a name matches any of the glob patterns
+func matchAny(patterns []string, name string) bool {
+  for _, pattern := range(patterns) {
+    if ok, _ := path.Match(pattern, name); ok {
+      return true
+    }
+  }
+  return false
+}
+
+// compares names so runs of digits compare as numbers: a2 < a10
+// a number followed by .<digit> is a version that carries on so V1__a comes
+// before V1.2__a
+// names that only differ by leading zeros compare as strings so the order is
+// always the same
+func naturalLess(a string, b string) bool {
+  x, y := a, b
+  number := false   // the last thing compared was a number
+  for len(x) > 0 && len(y) > 0 {
+    if number {
+      if xv, yv := isVersionDot(x), isVersionDot(y); xv != yv {
+        return yv
+      }
+      number = false
+    }
+    xd, yd := isDigit(x[0]), isDigit(y[0])
+    if xd && yd {
+      xn, xrest := leadingDigits(x)
+      yn, yrest := leadingDigits(y)
+      // compare the numbers without their leading zeros
+      xv, yv := strings.TrimLeft(xn, "0"), strings.TrimLeft(yn, "0")
+      if len(xv) != len(yv) {
+        return len(xv) < len(yv)
+      }
+      if xv != yv {
+        return xv < yv
+      }
+      x, y = xrest, yrest
+      number = true
+      continue
+    }
+    if x[0] != y[0] {
+      return x[0] < y[0]
+    }
+    x, y = x[1:], y[1:]
+  }
+  if len(x) != len(y) {
+    return len(x) < len(y)
+  }
+  return a < b
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// test for a . carrying on a version number
+func isVersionDot(s string) bool {
+  return len(s) >= 2 && s[0] == '.' && isDigit(s[1])
+}
+
+// splits the run of digits off the front of s
+func leadingDigits(s string) (string, string) {
+  i := 0
+  for i < len(s) && isDigit(s[i]) {
+    i++
   }
-  return nil, nil
+  return s[:i], s[i:]
 }
@@ -1,227 +1,611 @@
 package drift
-//
-// import (
-//   "testing"
-//   "os"
-//   "strings"
-//   "errors"
-//   "fmt"
-//   "time"
-//   "path/filepath"
-//   "log"
-// )
-//
-// // ----------------------------------------------------------------------------
-// // filesystem mock
-// // ----------------------------------------------------------------------------
-// // mock file
-// type mockFile struct {
-//   path  string
-//   data  *strings.Reader
-//   info  *mockFileInfo
-// }
-// func newMockFile(data string, path string, mode os.FileMode) *mockFile {
-//     return &mockFile{
-//       path,
-//       strings.NewReader(data),
-//       &mockFileInfo {
-//         name:    filepath.Base(path),
-//         size:    int64(len([]byte(data))),
-//         mode:    mode,
-//         modtime: time.Now(),
-//         isdir:   false,
-//         sys:     nil,
-//       },
-//     }
-// }
-// func (m *mockFile) Path() (string) { return m.path }
-// func (m *mockFile) Close() error { return nil }
-// func (m *mockFile) Read(p []byte) (n int, err error) { return m.data.Read(p) }
-// func (m *mockFile) ReadAt(p []byte, off int64) (n int, err error) {
-//   return m.data.ReadAt(p, off)
-// }
-// func (m *mockFile) Seek(offset int64, whence int) (int64, error) {
-//   return m.data.Seek(offset, whence)
-// }
-// func (m *mockFile) Stat() (os.FileInfo, error) { return m.info, nil }
-//
-// // mock file properties
-// type mockFileInfo struct {
-//   name    string
-//   size    int64
-//   mode    os.FileMode
-//   modtime time.Time
-//   isdir   bool
-//   sys     interface{}
-// }
-// func (m *mockFileInfo) Name() string { return m.name }
-// func (m *mockFileInfo) Size() int64{ return m.size }
-// func (m *mockFileInfo) Mode() os.FileMode { return m.mode }
-// func (m *mockFileInfo) ModTime() time.Time { return m.modtime }
-// func (m *mockFileInfo) IsDir() bool { return m.isdir }
-// func (m *mockFileInfo) Sys() interface{} { return m.sys }
-//
-// // mock filesystem
-// type mockFS struct{ files  map[string]file }
-// func newMockFS(files ...*mockFile) *mockFS {
-//   m := make(map[string]file)
-//   for _, f := range files {
-//     m[f.Path()] = f
-//   }
-//   return &mockFS{m}
-// }
-// func (m *mockFS) Open(name string) (file, error) {
-//   val, exists := m.files[name]
-//   if !exists {
-//     return nil, errors.New(fmt.Sprintf("%s: no such file or directory", name))
-//   }
-//   return val, nil
-// }
-// func (m *mockFS) Stat(name string) (os.FileInfo, error) {
-//   val, exists := m.files[name]
-//   if !exists {
-//     return nil, errors.New(fmt.Sprintf("%s: unable to stat file", name))
-//   }
-//   info, err := val.Stat()
-//   if err != nil {
-//     return nil, err
-//   }
-//   return info, nil
-// }
-// // ---------------------------------------------------------------------------
-// // tests
-// // ----------------------------------------------------------------------------
-//
-// func TestReadRevision(t *testing.T) {
-//   data := `
-//   -- +changeset id:hello kitty author:jgilbert dbms:ql runalways:true, runonchange:true, failonerror:true
-//   -- +preconditions dbms:ql tableexists:tablename colexists:colname fkexists:fkname indexexists:indexname
-//   -- +precondition-sql-check expectedResult:0 select count(*) from mytable
-//   -- +precondition-sql-check expectedResult:0 select count(*) from mytable
-//   -- +precondition-sql-check expectedResult:0 select count(*) from mytable
-//   -- +rollback DROP TABLE xxx;
-//     CREATE TABLE xxx;`
-//
-//   fs := newMockFS(newMockFile(data, "/tmp/migration.sql", 0644))
-//   revision, err := ReadRevision("/tmp/migration.sql", fs)
-//   if err != nil {
-//     t.Error(err)
-//   }
-//   if string(revision.data) != data {
-//     t.Error("Data returned is different than expected")
-//   }
-//
-//   revision, err = ReadRevision("/tmp/does/not/exist", fs)
-//   if err == nil {
-//     t.Error("File should not have been found")
-//   }
-// }
-//
-// func TestParseChangesets(t *testing.T) {
-//   data := `
-//   -- this is a comment
-//   /* this is also a comment */
-//   --+ changeset id:hello kitty author:jgilbert dbms:ql runalways:true, runonchange:true, failonerror:true
-//   --+ preconditions dbms:ql tableexists:tablename colexists:colname fkexists:fkname indexexists:indexname
-//   --+ precondition-sql-check expectedResult:0 select count(*) from mytable
-//   --+ rollback DROP TABLE xxx;
-//   CREATE TABLE говорю ;
-//   SELECT e.ID, e.говорю, e.DepartmentID, d.DepartmentID
-//   FROM
-//   	(SELECT id() AS ID, LastName, DepartmentID FROM employee) AS e,
-//   	department as d,
-//   WHERE e.DepartmentID == d.DepartmentID;
-//   // Will work.
-//
-//   /* here's a multiline comment
-//      that spans multiple lines */
-//   --- +changeset id:2
-//   CREATE TABLE exercise_logs
-//       (id INTEGER PRIMARY KEY AUTOINCREMENT,
-//       type TEXT,            -- 中国话不用彁字。
-//       minutes INTEGER,      -- this is a comment too
-//       calories INTEGER,     -- Αυτου οι θανατον μητσομαι
-//       heart_rate INTEGER);  -- this is a comment too
-//
-//   --- +changeset id:3
-//   SELECT id(), e.LastName, e.DepartmentID, d.DepartmentID
-//   FROM
-//   	employee AS e,
-//   	department AS d,
-//   WHERE e.DepartmentID == d.DepartmentID;
-//   // Will always return NULL in first field.
-//
-//   --+ changeset id:yes
-//   SELECT
-//   	__Column.TableName, __Column.Ordinal, __Column.Name, __Column.Type,
-//   	__Column2.NotNull, __Column2.ConstraintExpr, __Column2.DefaultExpr,
-//   FROM __Column
-//   LEFT JOIN __Column2 -- Αυτου οι θανατον μητσομαι
-//   ON __Column.TableName == __Column2.TableName && __Column.Name == __Column2.Name
-//   ORDER BY __Column.TableName, __Column.Ordinal;
-//
-//   --+ changeset id:no
-//   BEGIN TRANSACTION
-//   	UPDATE department
-//   		DepartmentName = DepartmentName + " dpt.",
-//   		DepartmentID = 1000+DepartmentID, -- Αυτου οι θανατον μητσομαι
-//   	WHERE DepartmentID < 1000;
-//   COMMIT;
-//
-//   -- +changeset id:hey
-//   BEGIN TRANSACTION;
-//   	INSERT INTO department (DepartmentID) VALUES (42);
-//
-//   	INSERT INTO department (
-//   		DepartmentName,
-//   		DepartmentID,
-//   	)
-//   	VALUES (
-//   		"R&D",
-//   		42,
-//   	);
-//
-//   	INSERT INTO department VALUES
-//   		(42, "R&D"),
-//   		(17, "Sales"),
-//   	;
-//   COMMIT;
-//
-//
-//   -- +changeset id:an
-//   BEGIN TRANSACTION;
-//   	CREATE TABLE t (
-//   		a int,
-//   		b int b > a && b < c DEFAULT (a+c)/2,
-//   		c int,
-//   );
-//   COMMIT;
-//   -- +changeset id:ss from
-//   BEGIN TRANSACTION;
-//   	CREATE TABLE department (
-//   		DepartmentID   int,
-//   		DepartmentName string DepartmentName IN ("HQ", "R/D", "Lab", "HR") DEFAULT "HQ",
-//   	);
-//   COMMIT;
-//
-//   -- +changeset id:fds index
-//   BEGIN TRANSACTION;
-//   	CREATE TABLE t (
-//   		TimeStamp time TimeStamp < now() && since(TimeStamp) < duration("10s"),
-//   		Event string Event != "" && Event like "[0-9]+:[ \t]+.*",
-//   	);
-//   COMMIT;
-//   -- sql comment
-//   // single line comment
-//   /* here's a multiline comment
-//      that spans multiple lines */
-//   `
-//
-//   fs := newMockFS(newMockFile(data, "/tmp/migration.sql", 0644))
-//   revision, _ := ReadRevision("/tmp/migration.sql", fs)
-//   changesets, err := ParseChangesets(revision)
-//   if err != nil {
-//     t.Error(err)
-//   }
-//   log.Println(changesets)
-// }
+
+import (
+  "os"
+  "testing"
+  "io"
+  "strings"
+  "fmt"
+  "io/ioutil"
+  "path/filepath"
+)
+
+func TestReadRevision(t *testing.T) {
+  data := `
+  -- +changeset id:hello kitty author:jgilbert dbms:ql runalways:true, runonchange:true, failonerror:true
+  -- +preconditions dbms:ql tableexists:tablename colexists:colname fkexists:fkname indexexists:indexname
+  -- +precondition-sql-check expectedResult:0 select count(*) from mytable
+  -- +precondition-sql-check expectedResult:0 select count(*) from mytable
+  -- +precondition-sql-check expectedResult:0 select count(*) from mytable
+  -- +rollback DROP TABLE xxx;
+    CREATE TABLE xxx;`
+
+  fs := NewMemFS()
+  fs.WriteFile("/tmp/migration.sql", []byte(data), 0644)
+  revision, err := ReadRevision("/tmp/migration.sql", fs)
+  if err != nil {
+    t.Error(err)
+  }
+  if string(revision.data) != data {
+    t.Error("Data returned is different than expected")
+  }
+
+  revision, err = ReadRevision("/tmp/does/not/exist", fs)
+  if err == nil {
+    t.Error("File should not have been found")
+  }
+}
+
+func TestReadRevisions(t *testing.T) {
+  fs := NewMemFS()
+  for _, p := range([]string{
+    "/db/V10__z.sql",
+    "/db/V2__y.sql",
+    "/db/V1__x.sql",
+    "/db/README.md",
+    "/db/V1.10__b.sql",
+    "/db/V1.2__a.sql",
+    "/db/V3/01_a.sql",
+    "/db/V3/01_a.txt",
+    "/db/seed.load",
+  }) {
+    fs.WriteFile(p, []byte("--+ changeset id:1\nSELECT 1;"), 0644)
+  }
+  revisions, err := ReadRevisions("/db", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var paths []string
+  for _, rev := range(revisions) {
+    paths = append(paths, rev.Path())
+  }
+  expected := "/db/V1__x.sql|/db/V1.2__a.sql|/db/V1.10__b.sql|/db/V2__y.sql|/db/V3/01_a.sql|/db/V10__z.sql"
+  if strings.Join(paths, "|") != expected {
+    t.Errorf("expected %v got %v", expected, strings.Join(paths, "|"))
+  }
+
+  revisions, err = ReadRevisions("/db/", fs, "*.load", "V1_*")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(revisions) != 2 || revisions[0].Path() != "/db/V1__x.sql" || revisions[1].Path() != "/db/seed.load" {
+    t.Errorf("unexpected revisions %v", revisions)
+  }
+
+  if _, err := ReadRevisions("/db", fs, "[a"); err == nil {
+    t.Errorf("expected a bad pattern to error")
+  }
+  if _, err := ReadRevisions("/nowhere", fs); err == nil {
+    t.Errorf("expected a missing directory to error")
+  }
+}
+
+func TestNaturalLess(t *testing.T) {
+  for _, value := range([][2]string{
+    {"a", "b"},
+    {"a2", "a10"},
+    {"V2__x.sql", "V10__a.sql"},
+    {"V1.2__a.sql", "V1.10__a.sql"},
+    {"V1__x.sql", "V1.2__a.sql"},
+    {"V1_x.sql", "V1.0.sql"},
+    {"V1.2.sql", "V1.2.1.sql"},
+    {"1.sql", "1a.sql"},
+    {"a", "ab"},
+    {"a01", "a1"},
+    {"a1", "a01b"},
+    {"a001", "a2"},
+  }) {
+    if !naturalLess(value[0], value[1]) || naturalLess(value[1], value[0]) {
+      t.Errorf("expected %v before %v", value[0], value[1])
+    }
+  }
+  if naturalLess("a1", "a1") {
+    t.Errorf("expected a name not to sort before itself")
+  }
+}
+
+func TestParseChangesets(t *testing.T) {
+  data := `
+  -- this is a comment
+  /* this is also a comment */
+  --+ changeset id:hello kitty author:jgilbert dbms:ql runalways:true, runonchange:true, failonerror:true
+  --+ preconditions dbms:ql tableexists:tablename colexists:colname fkexists:fkname indexexists:indexname
+  --+ precondition-sql-check expectedResult:0 select count(*) from mytable
+  --+ rollback DROP TABLE xxx;
+  CREATE TABLE говорю ;
+  SELECT e.ID, e.говорю, e.DepartmentID, d.DepartmentID
+  FROM
+  	(SELECT id() AS ID, LastName, DepartmentID FROM employee) AS e,
+  	department as d,
+  WHERE e.DepartmentID == d.DepartmentID;
+  // Will work.
+
+  /* here's a multiline comment
+     that spans multiple lines */
+  --- +changeset id:2
+  CREATE TABLE exercise_logs
+      (id INTEGER PRIMARY KEY AUTOINCREMENT,
+      type TEXT,            -- 中国话不用彁字。
+      minutes INTEGER,      -- this is a comment too
+      calories INTEGER,     -- Αυτου οι θανατον μητσομαι
+      heart_rate INTEGER);  -- this is a comment too
+
+  --- +changeset id:3
+  SELECT id(), e.LastName, e.DepartmentID, d.DepartmentID
+  FROM
+  	employee AS e,
+  	department AS d,
+  WHERE e.DepartmentID == d.DepartmentID;
+  // Will always return NULL in first field.
+
+  --+ changeset id:yes
+  SELECT
+  	__Column.TableName, __Column.Ordinal, __Column.Name, __Column.Type,
+  	__Column2.NotNull, __Column2.ConstraintExpr, __Column2.DefaultExpr,
+  FROM __Column
+  LEFT JOIN __Column2 -- Αυτου οι θανατον μητσομαι
+  ON __Column.TableName == __Column2.TableName && __Column.Name == __Column2.Name
+  ORDER BY __Column.TableName, __Column.Ordinal;
+
+  --+ changeset id:no
+  BEGIN TRANSACTION
+  	UPDATE department
+  		DepartmentName = DepartmentName + " dpt.",
+  		DepartmentID = 1000+DepartmentID, -- Αυτου οι θανατον μητσομαι
+  	WHERE DepartmentID < 1000;
+  COMMIT;
+
+  -- +changeset id:hey
+  BEGIN TRANSACTION;
+  	INSERT INTO department (DepartmentID) VALUES (42);
+
+  	INSERT INTO department (
+  		DepartmentName,
+  		DepartmentID,
+  	)
+  	VALUES (
+  		"R&D",
+  		42,
+  	);
+
+  	INSERT INTO department VALUES
+  		(42, "R&D"),
+  		(17, "Sales"),
+  	;
+  COMMIT;
+
+
+  -- +changeset id:an
+  BEGIN TRANSACTION;
+  	CREATE TABLE t (
+  		a int,
+  		b int b > a && b < c DEFAULT (a+c)/2,
+  		c int,
+  );
+  COMMIT;
+  -- +changeset id:ss from
+  BEGIN TRANSACTION;
+  	CREATE TABLE department (
+  		DepartmentID   int,
+  		DepartmentName string DepartmentName IN ("HQ", "R/D", "Lab", "HR") DEFAULT "HQ",
+  	);
+  COMMIT;
+
+  -- +changeset id:fds index
+  BEGIN TRANSACTION;
+  	CREATE TABLE t (
+  		TimeStamp time TimeStamp < now() && since(TimeStamp) < duration("10s"),
+  		Event string Event != "" && Event like "[0-9]+:[ \t]+.*",
+  	);
+  COMMIT;
+  -- sql comment
+  // single line comment
+  /* here's a multiline comment
+     that spans multiple lines */
+  `
+
+  fs := NewMemFS()
+  fs.WriteFile("/tmp/migration.sql", []byte(data), 0644)
+  revision, _ := ReadRevision("/tmp/migration.sql", fs)
+  changesets, err := ParseChangesets(revision)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the '--- +changeset' and '-- +changeset' lines are plain sql comments
+  if len(changesets) != 3 {
+    t.Fatalf("expected %v changesets got %v", 3, len(changesets))
+  }
+  for index, value := range([]struct{
+    id      string
+    headers int
+    prefix  string
+    suffix  string
+  }{
+    {"hello kitty", 3, "CREATE TABLE говорю ;", "// Will always return NULL in first field."},
+    {"yes", 0, "SELECT\n", "ORDER BY __Column.TableName, __Column.Ordinal;"},
+    {"no", 0, "BEGIN TRANSACTION\n", "that spans multiple lines */"},
+  }) {
+    cs := changesets[index]
+    if cs.header.id != value.id {
+      t.Errorf("changeset %v: expected id '%v' got '%v'", index, value.id, cs.header.id)
+    }
+    if len(cs.headers) != value.headers {
+      t.Errorf("changeset %v: expected %v headers got %v", index, value.headers, len(cs.headers))
+    }
+    if !strings.HasPrefix(cs.sql, value.prefix) {
+      t.Errorf("changeset %v: expected sql to start with '%v' got '%v'", index, value.prefix, cs.sql)
+    }
+    if !strings.HasSuffix(cs.sql, value.suffix) {
+      t.Errorf("changeset %v: expected sql to end with '%v' got '%v'", index, value.suffix, cs.sql)
+    }
+  }
+  if changesets[0].rollback != "DROP TABLE xxx;" {
+    t.Errorf("expected rollback '%v' got '%v'", "DROP TABLE xxx;", changesets[0].rollback)
+  }
+  if !strings.Contains(changesets[0].sql, "--- +changeset id:2") {
+    t.Errorf("expected sql comments to be kept in the changeset sql")
+  }
+}
+
+func TestParseChangesetsEmpty(t *testing.T) {
+  data := `
+  -- nothing but comments
+  /* in this file */`
+  changesets, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/empty.sql"})
+  if err != nil {
+    t.Errorf("unexpected error %v", err)
+  }
+  if len(changesets) != 0 {
+    t.Errorf("expected %v changesets got %v", 0, len(changesets))
+  }
+}
+
+func TestParseChangesetsBad(t *testing.T) {
+  for data, expected := range(map[string]string{
+    "CREATE TABLE t;":                                          "/tmp/bad.sql:1:1: sql found outside of a changeset",
+    "--+ rollback DROP TABLE t;":                               "/tmp/bad.sql:1:1: header found outside of a changeset",
+    "--+ changeset author:me\nCREATE TABLE t;":                "/tmp/bad.sql:1:1: changeset header is missing an id",
+    "--+ changeset id:1\n\n--+ changeset id:2\nSELECT 1;":   "/tmp/bad.sql:1:1: changeset has no sql",
+    "--+ changeset id:1\nSELECT 1;\n  --+ rollback SELECT 2;": "/tmp/bad.sql:3:3: header found after changeset sql",
+    "--+ changeset id:a\nSELECT 1;\n--+ changeset id:a\nSELECT 2;": "/tmp/bad.sql:3:1: duplicate changeset id 'a'",
+  }) {
+    _, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/bad.sql"})
+    if err == nil {
+      t.Errorf("expected an error parsing '%v'", data)
+      continue
+    }
+    if _, ok := err.(ParseErrors); !ok {
+      t.Errorf("expected ParseErrors got %T", err)
+    }
+    if err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err.Error())
+    }
+  }
+}
+
+func TestParseChangesetsRollback(t *testing.T) {
+  data := `
+--+ changeset id:1
+--+ rollback DROP INDEX a_id;
+--+rollback DROP TABLE a;
+CREATE TABLE a (id int);
+CREATE INDEX a_id ON a (id);
+--+ changeset id:2
+CREATE TABLE b (id int);
+INSERT INTO b VALUES (1);
+--+ rollback
+-- the rollback block runs to the next changeset
+DELETE FROM b;
+DROP TABLE b;
+
+--+ changeset id:3
+CREATE TABLE c (id int);`
+  changesets, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/1.sql"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for index, value := range([]struct{
+    sql      string
+    rollback string
+  }{
+    {"CREATE TABLE a (id int);\nCREATE INDEX a_id ON a (id);", "DROP INDEX a_id;\nDROP TABLE a;"},
+    {"CREATE TABLE b (id int);\nINSERT INTO b VALUES (1);", "-- the rollback block runs to the next changeset\nDELETE FROM b;\nDROP TABLE b;"},
+    {"CREATE TABLE c (id int);", ""},
+  }) {
+    cs := changesets[index]
+    if cs.SQL() != value.sql {
+      t.Errorf("changeset %v: expected sql '%v' got '%v'", index, value.sql, cs.SQL())
+    }
+    if cs.Rollback() != value.rollback {
+      t.Errorf("changeset %v: expected rollback '%v' got '%v'", index, value.rollback, cs.Rollback())
+    }
+  }
+}
+
+func TestParseChangesetsRollbackBad(t *testing.T) {
+  for data, expected := range(map[string]string{
+    "--+ changeset id:1\n--+ rollback\nDROP TABLE t;":                      "/tmp/bad.sql:1:1: changeset has no sql",
+    "--+ changeset id:1\nSELECT 1;\n--+ rollback\nSELECT 2;\n--+ rollback": "/tmp/bad.sql:5:1: header found in rollback block",
+  }) {
+    _, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/bad.sql"})
+    if err == nil {
+      t.Errorf("expected an error parsing '%v'", data)
+      continue
+    }
+    if err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err.Error())
+    }
+  }
+}
+
+// parsing carries on after an error and reports everything it finds
+func TestParseChangesetsManyErrors(t *testing.T) {
+  data := `-- the first statement is outside of a changeset
+SELECT 1; SELECT 2;
+--+ changeset id:1 runalways:maybe
+SELECT 3;
+--+ changeset id:2
+--+ changeset id:3
+SELECT 4;`
+  changesets, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/bad.sql"})
+  if changesets != nil {
+    t.Errorf("expected no changesets got %v", changesets)
+  }
+  errs, ok := err.(ParseErrors)
+  if !ok {
+    t.Fatalf("expected ParseErrors got %T", err)
+  }
+  for index, expected := range([]struct{
+    line    int
+    column  int
+    snippet string
+  }{
+    {2, 1, "SELECT 1; SELECT 2;"},
+    {3, 20, "--+ changeset id:1 runalways:maybe"},
+    {5, 1, "--+ changeset id:2"},
+  }) {
+    if index >= len(errs) {
+      t.Fatalf("expected %v errors got %v", 3, len(errs))
+    }
+    e := errs[index]
+    if e.Path != "/tmp/bad.sql" || e.Line != expected.line || e.Column != expected.column {
+      t.Errorf("expected %v:%v got %v:%v", expected.line, expected.column, e.Line, e.Column)
+    }
+    if e.Snippet != expected.snippet {
+      t.Errorf("expected snippet '%v' got '%v'", expected.snippet, e.Snippet)
+    }
+  }
+  if len(errs) != 3 {
+    t.Errorf("expected %v errors got %v", 3, len(errs))
+  }
+  expected := "/tmp/bad.sql:2:1: sql found outside of a changeset (and 2 more errors)"
+  if err.Error() != expected {
+    t.Errorf("expected '%v' got '%v'", expected, err.Error())
+  }
+}
+
+// comment markers inside quotes are part of the sql
+func TestParseChangesetsQuoted(t *testing.T) {
+  sql := "INSERT INTO t VALUES ('--+ changeset id:2', \"http://host\", '/*%');\n" +
+    "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; -- one\n$$ LANGUAGE sql;"
+  changesets, err := ParseChangesets(&Revision{data: []byte("--+ changeset id:1\n" + sql), path: "/tmp/1.sql"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(changesets) != 1 || changesets[0].SQL() != sql {
+    t.Errorf("expected %v got %v", sql, changesets)
+  }
+
+  _, err = ParseChangesets(&Revision{data: []byte("--+ changeset id:1\nSELECT 'oops;\n"), path: "/tmp/1.sql"})
+  expected := "/tmp/1.sql:2:8: unterminated string"
+  if err == nil || err.Error() != expected {
+    t.Errorf("expected '%v' got '%v'", expected, err)
+  }
+}
+
+// a delimiter header or attribute changes what statements are split on
+func TestParseChangesetsDelimiter(t *testing.T) {
+  data := `--+ changeset id:1
+--+ delimiter $$
+CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END $$
+CREATE PROCEDURE q() BEGIN SELECT 3; END$$
+--+ changeset id:2 endDelimiter://
+--+ rollback DROP TRIGGER t//
+CREATE TRIGGER t BEGIN SELECT 4; END //
+--+ changeset id:3 splitstatements:false
+DO $$ BEGIN PERFORM 1; END $$;
+SELECT 5;
+--+ changeset id:4
+SELECT 6; SELECT 7;
+--+ changeset id:5 enddelimiter:GO
+SELECT CATEGORY FROM t
+GO
+GOTO x
+GO`
+  changesets, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/1.sql"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for index, value := range([]struct{
+    delimiter  string
+    statements []string
+    rollbacks  []string
+  }{
+    {"$$", []string{"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END", "CREATE PROCEDURE q() BEGIN SELECT 3; END"}, nil},
+    {"//", []string{"CREATE TRIGGER t BEGIN SELECT 4; END"}, []string{"DROP TRIGGER t"}},
+    {";", []string{"DO $$ BEGIN PERFORM 1; END $$;\nSELECT 5;"}, nil},
+    {";", []string{"SELECT 6;", "SELECT 7;"}, nil},
+    {"GO", []string{"SELECT CATEGORY FROM t", "GOTO x"}, nil},
+  }) {
+    cs := changesets[index]
+    if cs.Delimiter() != value.delimiter {
+      t.Errorf("%v: expected delimiter %v got %v", cs.ID(), value.delimiter, cs.Delimiter())
+    }
+    if fmt.Sprintf("%q", cs.Statements()) != fmt.Sprintf("%q", value.statements) {
+      t.Errorf("%v: expected %q got %q", cs.ID(), value.statements, cs.Statements())
+    }
+    if fmt.Sprintf("%q", cs.RollbackStatements()) != fmt.Sprintf("%q", value.rollbacks) {
+      t.Errorf("%v: expected %q got %q", cs.ID(), value.rollbacks, cs.RollbackStatements())
+    }
+  }
+  if changesets[2].SplitStatements() || !changesets[3].SplitStatements() {
+    t.Errorf("expected only changeset 3 to run as one statement")
+  }
+}
+
+func TestParseChangesetsDelimiterBad(t *testing.T) {
+  for data, expected := range(map[string]string{
+    "--+ changeset id:1\n--+ delimiter\nSELECT 1;":                        "/tmp/1.sql:2:1: delimiter is missing",
+    "--+ changeset id:1\n--+ delimiter a b\nSELECT 1;":                    "/tmp/1.sql:2:1: invalid delimiter 'a b'",
+    "--+ changeset id:1\n--+ delimiter //\n--+ delimiter $$\nSELECT 1;":   "/tmp/1.sql:3:1: delimiter given more than once",
+    "--+ changeset id:1 enddelimiter:$$\n--+ delimiter //\nSELECT 1;":     "/tmp/1.sql:2:1: delimiter given more than once",
+  }) {
+    _, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/1.sql"})
+    if err == nil || err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err)
+    }
+  }
+}
+
+// changesets are returned one at a time and errors as soon as they're found
+func TestChangesetReader(t *testing.T) {
+  data := `--+ changeset id:1
+SELECT 1;
+--+ changeset id:2 runalways:maybe
+SELECT 2;
+--+ changeset id:3
+SELECT 3;`
+  r := NewChangesetReader("/tmp/1.sql", strings.NewReader(data))
+  cs, err := r.Next()
+  if err != nil || cs.ID() != "1" || cs.SQL() != "SELECT 1;" {
+    t.Errorf("expected changeset 1 got %v %v", cs, err)
+  }
+  cs, err = r.Next()
+  errs, ok := err.(ParseErrors)
+  if cs != nil || !ok || len(errs) != 1 {
+    t.Fatalf("expected a ParseError got %v %v", cs, err)
+  }
+  if errs[0].Line != 3 || errs[0].Snippet != "--+ changeset id:2 runalways:maybe" {
+    t.Errorf("expected an error on line 3 got %v '%v'", errs[0], errs[0].Snippet)
+  }
+  // carry on past the error
+  cs, err = r.Next()
+  if err != nil || cs.ID() != "3" || cs.SQL() != "SELECT 3;" {
+    t.Errorf("expected changeset 3 got %v %v", cs, err)
+  }
+  for i := 0; i < 2; i++ {
+    if cs, err = r.Next(); cs != nil || err != io.EOF {
+      t.Errorf("expected EOF got %v %v", cs, err)
+    }
+  }
+}
+
+// streamed revisions are only opened when they're parsed
+func TestOpenRevision(t *testing.T) {
+  data := `--+ changeset id:1
+SELECT 1;
+--+ changeset id:2
+SELECT 2;`
+  fs := NewMemFS()
+  fs.WriteFile("/tmp/migration.sql", []byte(data), 0644)
+  revision, err := OpenRevision("/tmp/migration.sql", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revision.Data() != nil || revision.Path() != "/tmp/migration.sql" {
+    t.Errorf("expected a streamed revision got %v", revision)
+  }
+  // revisions can be parsed more than once
+  for i := 0; i < 2; i++ {
+    changesets, err := ParseChangesets(revision)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(changesets) != 2 || changesets[1].SQL() != "SELECT 2;" {
+      t.Errorf("expected %v changesets got %v", 2, changesets)
+    }
+  }
+
+  if _, err := OpenRevision("/tmp/does/not/exist", fs); err == nil {
+    t.Error("File should not have been found")
+  }
+}
+
+func TestChangesetAccessors(t *testing.T) {
+  data := `--+ changeset id:hello kitty author:jgilbert dbms:ql runalways:true, context:dev
+--+ rollback DROP TABLE xxx;
+CREATE TABLE xxx;`
+  fs := NewMemFS()
+  fs.WriteFile("/tmp/migration.sql", []byte(data), 0644)
+  revision, err := ReadRevision("/tmp/migration.sql", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revision.Path() != "/tmp/migration.sql" {
+    t.Errorf("expected %v got %v", "/tmp/migration.sql", revision.Path())
+  }
+  if string(revision.Data()) != data {
+    t.Error("Data returned is different than expected")
+  }
+  changesets, err := ParseChangesets(revision)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(changesets) != 1 {
+    t.Fatalf("expected %v changesets got %v", 1, len(changesets))
+  }
+  cs := changesets[0]
+  if cs.ID() != "hello kitty" || cs.Author() != "jgilbert" {
+    t.Errorf("unexpected id '%v' author '%v'", cs.ID(), cs.Author())
+  }
+  if len(cs.DBMS()) != 1 || cs.DBMS()[0] != "ql" {
+    t.Errorf("expected %v got %v", []string{"ql"}, cs.DBMS())
+  }
+  if !cs.RunAlways() || cs.RunOnChange() || !cs.FailOnError() {
+    t.Errorf("unexpected flags %v %v %v", cs.RunAlways(), cs.RunOnChange(), cs.FailOnError())
+  }
+  if value, ok := cs.Attribute("Context"); !ok || value != "dev" {
+    t.Errorf("expected %v got %v", "dev", value)
+  }
+  if len(cs.Headers()) != 1 || cs.Headers()[0] != "--+ rollback DROP TABLE xxx;" {
+    t.Errorf("unexpected headers %v", cs.Headers())
+  }
+  if cs.SQL() != "CREATE TABLE xxx;" {
+    t.Errorf("expected %v got %v", "CREATE TABLE xxx;", cs.SQL())
+  }
+  if cs.Line() != 3 {
+    t.Errorf("expected %v got %v", 3, cs.Line())
+  }
+  if len(cs.Statements()) != 1 || cs.Statements()[0] != "CREATE TABLE xxx;" {
+    t.Errorf("unexpected statements %v", cs.Statements())
+  }
+  if len(cs.RollbackStatements()) != 1 || cs.RollbackStatements()[0] != "DROP TABLE xxx;" {
+    t.Errorf("unexpected rollback statements %v", cs.RollbackStatements())
+  }
+}
+
+// paths are relative to the root however it's written
+func TestDirFileSystem(t *testing.T) {
+  root := t.TempDir()
+  dir := filepath.Join(root, "migrations")
+  os.MkdirAll(filepath.Join(dir, "V2"), 0755)
+  ioutil.WriteFile(filepath.Join(dir, "V1.sql"), []byte("--+ changeset id:1\nSELECT 1;"), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "V2", "a.sql"), []byte("--+ changeset id:2\nSELECT 2;"), 0644)
+  t.Chdir(root)
+  for _, value := range([]string{"migrations", "./migrations/", dir}) {
+    revisions, err := ReadRevisions(".", DirFileSystem{value})
+    if err != nil {
+      t.Fatal(err)
+    }
+    var paths []string
+    for _, rev := range(revisions) {
+      paths = append(paths, rev.Path())
+    }
+    if strings.Join(paths, "|") != "V1.sql|V2/a.sql" {
+      t.Errorf("%v: expected V1.sql|V2/a.sql got %v", value, paths)
+    }
+  }
+  if _, err := ReadRevision("V1.sql", DirFileSystem{root}); err == nil {
+    t.Errorf("expected a path outside of the root's directory to be missing")
+  }
+}
@@ -0,0 +1,83 @@
+package drift
+
+import (
+  "fmt"
+  "strings"
+)
+
+// A ParseError is a problem found at a position in a revision
+type ParseError struct {
+  Path    string   // path of the revision
+  Line    int      // line the error was found on, starting at 1
+  Column  int      // column (in runes) the error was found at, starting at 1
+  Snippet string   // the text of the offending line
+  Msg     string
+}
+
+func newParseError(path string, line int, column int, format string, args ...interface{}) *ParseError {
+  return &ParseError{
+    Path:   path,
+    Line:   line,
+    Column: column,
+    Msg:    fmt.Sprintf(format, args...),
+  }
+}
+
+// path:line:column: message
+func (e *ParseError) Error() string {
+  if len(e.Path) == 0 {
+    return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+  }
+  return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Column, e.Msg)
+}
+
+// the error followed by the offending line and a marker under the column
+func (e *ParseError) Detail() string {
+  if len(e.Snippet) == 0 {
+    return e.Error()
+  }
+  marker := make([]rune, 0, e.Column)
+  for i, r := range([]rune(e.Snippet)) {
+    if i >= e.Column - 1 {
+      break
+    }
+    // keep tabs so the marker lines up
+    if r == '\t' {
+      marker = append(marker, '\t')
+    } else {
+      marker = append(marker, ' ')
+    }
+  }
+  return fmt.Sprintf("%s\n%s\n%s^", e.Error(), e.Snippet, string(marker))
+}
+
+// ParseErrors are all of the errors found parsing a revision
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+  switch len(e) {
+  case 0:
+    return "no errors"
+  case 1:
+    return e[0].Error()
+  }
+  return fmt.Sprintf("%s (and %d more errors)", e[0].Error(), len(e) - 1)
+}
+
+// every error followed by its snippet
+func (e ParseErrors) Detail() string {
+  var details []string
+  for _, err := range(e) {
+    details = append(details, err.Detail())
+  }
+  return strings.Join(details, "\n")
+}
+
+// returns the text of a line in data, lines start at 1
+func lineOf(data []byte, lineno int) string {
+  lines := strings.SplitN(string(data), "\n", lineno + 1)
+  if lineno < 1 || lineno > len(lines) {
+    return ""
+  }
+  return strings.TrimRight(lines[lineno - 1], "\r")
+}
@@ -0,0 +1,62 @@
+package drift
+
+import (
+  "testing"
+)
+
+func TestParseErrorDetail(t *testing.T) {
+  err := &ParseError{
+    Path:    "/tmp/migration.sql",
+    Line:    3,
+    Column:  5,
+    Snippet: "\t风雷 bad",
+    Msg:     "something is wrong",
+  }
+  expected := "/tmp/migration.sql:3:5: something is wrong\n\t风雷 bad\n\t   ^"
+  if err.Detail() != expected {
+    t.Errorf("expected '%v' got '%v'", expected, err.Detail())
+  }
+
+  // no snippet is just the error
+  err.Snippet = ""
+  if err.Detail() != err.Error() {
+    t.Errorf("expected '%v' got '%v'", err.Error(), err.Detail())
+  }
+
+  // errors from the scanner don't know the path
+  err.Path = ""
+  if err.Error() != "3:5: something is wrong" {
+    t.Errorf("expected '%v' got '%v'", "3:5: something is wrong", err.Error())
+  }
+}
+
+func TestParseErrors(t *testing.T) {
+  errs := ParseErrors{
+    newParseError("a.sql", 1, 2, "first"),
+    newParseError("a.sql", 3, 4, "second"),
+  }
+  if errs.Error() != "a.sql:1:2: first (and 1 more errors)" {
+    t.Errorf("unexpected error '%v'", errs.Error())
+  }
+  if errs[:1].Error() != "a.sql:1:2: first" {
+    t.Errorf("unexpected error '%v'", errs[:1].Error())
+  }
+  if errs.Detail() != "a.sql:1:2: first\na.sql:3:4: second" {
+    t.Errorf("unexpected detail '%v'", errs.Detail())
+  }
+}
+
+func TestLineOf(t *testing.T) {
+  data := []byte("one\r\ntwo\nthree")
+  for lineno, expected := range(map[int]string{
+    0: "",
+    1: "one",
+    2: "two",
+    3: "three",
+    4: "",
+  }) {
+    if lineOf(data, lineno) != expected {
+      t.Errorf("expected '%v' got '%v'", expected, lineOf(data, lineno))
+    }
+  }
+}
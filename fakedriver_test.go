@@ -0,0 +1,210 @@
+package drift
+
+import (
+  "io"
+  "fmt"
+  "sort"
+  "sync"
+  "strings"
+  "testing"
+  "database/sql"
+  "database/sql/driver"
+)
+
+// ----------------------------------------------------------------------------
+// database/sql driver mock
+// ----------------------------------------------------------------------------
+// every statement run against a fake database is recorded, statements
+// containing one of the fail strings return the matching error
+// statements against the history table are kept apart from the rest and
+// stored as rows of historyColumns
+// rolling back a transaction forgets the statements run since it began
+type fakeDB struct {
+  mu       sync.Mutex
+  executed []string
+  fail     map[string]error
+  table    string
+  created  bool
+  history  [][]driver.Value
+  // answers any other query with a single value
+  answer   func(query string, args []driver.Value) (driver.Value, error)
+}
+
+func (db *fakeDB) exec(query string, args []driver.Value) (driver.Result, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  for match, err := range(db.fail) {
+    if strings.Contains(query, match) {
+      return nil, err
+    }
+  }
+  if strings.Contains(query, " " + db.table + " ") {
+    return db.execHistory(query, args)
+  }
+  db.executed = append(db.executed, query)
+  return driver.RowsAffected(1), nil
+}
+
+func (db *fakeDB) execHistory(query string, args []driver.Value) (driver.Result, error) {
+  switch {
+  case strings.HasPrefix(query, "CREATE TABLE"):
+    db.created = true
+    return driver.RowsAffected(0), nil
+  case !db.created:
+    return nil, fmt.Errorf("fake: no table %s", db.table)
+  case strings.HasPrefix(query, "INSERT INTO"):
+    db.history = append(db.history, args)
+    return driver.RowsAffected(1), nil
+  case strings.HasPrefix(query, "UPDATE"):
+    // author, checksum, dateexecuted, elapsed, status, orderexecuted, revision, changeset
+    for _, row := range(db.history) {
+      if row[0] == args[6] && row[1] == args[7] {
+        copy(row[2:], args[:6])
+        return driver.RowsAffected(1), nil
+      }
+    }
+    return driver.RowsAffected(0), nil
+  case strings.HasPrefix(query, "DELETE FROM"):
+    // revision, changeset
+    for i, row := range(db.history) {
+      if row[0] == args[0] && row[1] == args[1] {
+        db.history = append(db.history[:i], db.history[i+1:]...)
+        return driver.RowsAffected(1), nil
+      }
+    }
+    return driver.RowsAffected(0), nil
+  }
+  return nil, fmt.Errorf("fake: unsupported statement %s", query)
+}
+
+func (db *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  // a count of tables named like the history table checks it exists
+  if len(args) == 1 && args[0] == db.table && strings.HasPrefix(query, "SELECT count(*)") {
+    exists := int64(0)
+    if db.created {
+      exists = 1
+    }
+    return &fakeRows{[]string{"count"}, [][]driver.Value{{exists}}}, nil
+  }
+  if !strings.Contains(query, " " + db.table + " ") && db.answer != nil {
+    value, err := db.answer(query, args)
+    if err != nil {
+      return nil, err
+    }
+    return &fakeRows{[]string{"value"}, [][]driver.Value{{value}}}, nil
+  }
+  if !strings.Contains(query, " " + db.table + " ") || !strings.HasPrefix(query, "SELECT") {
+    return nil, fmt.Errorf("fake: unsupported query %s", query)
+  }
+  if !db.created {
+    return nil, fmt.Errorf("fake: no table %s", db.table)
+  }
+  rows := append([][]driver.Value(nil), db.history...)
+  sort.SliceStable(rows, func(i, j int) bool {
+    return rows[i][7].(int64) < rows[j][7].(int64)
+  })
+  return &fakeRows{strings.Split(historyColumns, ", "), rows}, nil
+}
+
+// the statements run so far
+func (db *fakeDB) statements() []string {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  return append([]string(nil), db.executed...)
+}
+
+var fakeDBs = struct{
+  sync.Mutex
+  dbs map[string]*fakeDB
+}{dbs: make(map[string]*fakeDB)}
+
+func init() {
+  sql.Register("drift-fake", fakeDriver{})
+}
+
+// opens a new fake database named after the test
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+  fake := &fakeDB{fail: make(map[string]error), table: DefaultHistoryTable}
+  fakeDBs.Lock()
+  fakeDBs.dbs[t.Name()] = fake
+  fakeDBs.Unlock()
+  db, err := sql.Open("drift-fake", t.Name())
+  if err != nil {
+    t.Fatal(err)
+  }
+  return db, fake
+}
+
+type fakeDriver struct{}
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+  fakeDBs.Lock()
+  defer fakeDBs.Unlock()
+  db, exists := fakeDBs.dbs[name]
+  if !exists {
+    return nil, fmt.Errorf("fake: no database named %s", name)
+  }
+  return &fakeConn{db}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+  return &fakeStmt{c.db, query}, nil
+}
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+  c.db.mu.Lock()
+  defer c.db.mu.Unlock()
+  tx := &fakeTx{db: c.db, executed: len(c.db.executed), created: c.db.created}
+  for _, row := range(c.db.history) {
+    tx.history = append(tx.history, append([]driver.Value(nil), row...))
+  }
+  return tx, nil
+}
+
+// a transaction remembers the database as it was when it began
+type fakeTx struct {
+  db       *fakeDB
+  executed int
+  created  bool
+  history  [][]driver.Value
+}
+func (tx *fakeTx) Commit() error { return nil }
+func (tx *fakeTx) Rollback() error {
+  tx.db.mu.Lock()
+  defer tx.db.mu.Unlock()
+  tx.db.executed = tx.db.executed[:tx.executed]
+  tx.db.created = tx.created
+  tx.db.history = tx.history
+  return nil
+}
+
+type fakeStmt struct {
+  db    *fakeDB
+  query string
+}
+func (s *fakeStmt) Close() error { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+  return s.db.exec(s.query, args)
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+  return s.db.query(s.query, args)
+}
+
+// rows returned from a fake query
+type fakeRows struct {
+  columns []string
+  rows    [][]driver.Value
+}
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+  if len(r.rows) == 0 {
+    return io.EOF
+  }
+  copy(dest, r.rows[0])
+  r.rows = r.rows[1:]
+  return nil
+}
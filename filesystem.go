@@ -3,14 +3,20 @@ package drift
 import (
   "os"
   "io"
+  "io/ioutil"
+  "path/filepath"
 )
 
-type filesystem interface {
-  Open(name string) (file, error)
+// A FileSystem is anything revisions can be read from
+type FileSystem interface {
+  Open(name string) (File, error)
   Stat(name string) (os.FileInfo, error)
+  // the entries of a directory sorted by name
+  ReadDir(name string) ([]os.FileInfo, error)
 }
 
-type file interface {
+// A File is an open file on a FileSystem
+type File interface {
   io.Closer
   io.Reader
   io.ReaderAt
@@ -18,10 +24,42 @@ type file interface {
   Stat() (os.FileInfo, error)
 }
 
+// OSFileSystem is the FileSystem of the local disk
 type OSFileSystem struct{}
-func (OSFileSystem) Open(name string) (file, error) {
+func (OSFileSystem) Open(name string) (File, error) {
   return os.Open(name)
 }
 func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
   return os.Stat(name)
 }
+func (OSFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+  return ioutil.ReadDir(name)
+}
+
+// DirFileSystem is the local disk with relative paths taken from Root rather
+// than the working directory
+// revisions read through it have paths relative to Root, and since the
+// history is keyed on revision paths it's the same whichever directory
+// migrations are run from and however Root is written
+// e.g. ReadRevisions(".", DirFileSystem{Root: "migrations"})
+type DirFileSystem struct {
+  Root string
+}
+
+// the path on disk of a path relative to the root, absolute paths are as is
+func (d DirFileSystem) path(name string) string {
+  if filepath.IsAbs(name) {
+    return name
+  }
+  return filepath.Join(d.Root, filepath.FromSlash(name))
+}
+
+func (d DirFileSystem) Open(name string) (File, error) {
+  return os.Open(d.path(name))
+}
+func (d DirFileSystem) Stat(name string) (os.FileInfo, error) {
+  return os.Stat(d.path(name))
+}
+func (d DirFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+  return ioutil.ReadDir(d.path(name))
+}
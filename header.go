@@ -0,0 +1,234 @@
+package drift
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "strconv"
+  "unicode"
+)
+
+// the attributes of a '--+ changeset' header
+// e.g. --+ changeset id:hello kitty author:jgilbert dbms:ql runalways:true, failonerror:false
+type changesetHeader struct {
+  id          string
+  author      string
+  dbms        []string
+  runAlways   bool
+  runOnChange bool
+  failOnError bool
+  splitStatements bool            // split the sql in to statements, true unless given
+  endDelimiter    string          // what statements are split on, ; if empty
+  attributes  map[string]string   // any keys we don't know about
+}
+
+// a single whitespace separated word of a header and the column it started at
+type headerWord struct {
+  text   string
+  column int
+}
+
+// a key:value attribute of a header and the column it started at
+type attribute struct {
+  key    string
+  value  string
+  column int
+}
+
+// parses the key:value attributes out of the words of a header
+// a value runs up to the next key so values can contain spaces
+// (id:hello kitty), trailing commas are ignored
+// keys are case insensitive, a key can only be given once
+func parseAttributes(path string, tok *Token, words []headerWord) ([]attribute, error) {
+  var attrs []attribute
+  seen := make(map[string]bool)
+  for len(words) > 0 {
+    key, value, ok := splitAttribute(words[0].text)
+    if !ok {
+      return nil, newParseError(path, tok.lineno, words[0].column, "expected key:value got '%s'", words[0].text)
+    }
+    column := words[0].column
+    words = words[1:]
+    // pull in the rest of a multi-word value
+    for len(words) > 0 {
+      if _, _, ok := splitAttribute(words[0].text); ok {
+        break
+      }
+      value = value + " " + words[0].text
+      words = words[1:]
+    }
+    value = strings.TrimSpace(strings.TrimRight(value, ", "))
+
+    if seen[key] {
+      return nil, newParseError(path, tok.lineno, column, "duplicate attribute '%s'", key)
+    }
+    seen[key] = true
+    attrs = append(attrs, attribute{key, value, column})
+  }
+  return attrs, nil
+}
+
+// the words of a header after the '--+' and the header name
+func headerArguments(tok *Token) []headerWord {
+  words := splitHeader(tok)
+  if len(words) > 0 && words[0].text == "--+" {
+    words = words[1:]
+  }
+  if len(words) > 0 {
+    words = words[1:]
+  }
+  return words
+}
+
+// parses the attributes out of a '--+ changeset' header token
+// defaults are attributes for the header to have when it doesn't give them
+// itself, see Migrator.SetDefaultAttributes
+func parseChangesetHeader(path string, tok *Token, defaults map[string]string) (changesetHeader, error) {
+  h := newChangesetHeader()
+  attrs, err := parseAttributes(path, tok, headerArguments(tok))
+  if err != nil {
+    return h, err
+  }
+
+  given := make(map[string]bool)
+  for _, attr := range(attrs) {
+    given[attr.key] = true
+  }
+  for _, key := range(sortedKeys(defaults)) {
+    if !given[strings.ToLower(key)] {
+      attrs = append(attrs, attribute{strings.ToLower(key), defaults[key], tok.column})
+    }
+  }
+
+  for _, attr := range(attrs) {
+    if err := h.set(attr.key, attr.value); err != nil {
+      return h, newParseError(path, tok.lineno, attr.column, "%v", err)
+    }
+  }
+
+  if len(h.id) == 0 {
+    return h, newParseError(path, tok.lineno, tok.column, "changeset header is missing an id")
+  }
+  return h, nil
+}
+
+// a header with nothing given
+func newChangesetHeader() changesetHeader {
+  return changesetHeader{
+    failOnError:     true,
+    splitStatements: true,
+    attributes:      make(map[string]string),
+  }
+}
+
+// sets an attribute of the header, keys are lower case
+func (h *changesetHeader) set(key string, value string) error {
+  var err error
+  switch key {
+  case "id":
+    h.id = value
+  case "author":
+    h.author = value
+  case "dbms":
+    h.dbms = splitList(value)
+  case "runalways":
+    h.runAlways, err = strconv.ParseBool(value)
+  case "runonchange":
+    h.runOnChange, err = strconv.ParseBool(value)
+  case "failonerror":
+    h.failOnError, err = strconv.ParseBool(value)
+  case "splitstatements":
+    h.splitStatements, err = strconv.ParseBool(value)
+  case "enddelimiter":
+    if len(value) == 0 || strings.ContainsAny(value, " \t") {
+      return fmt.Errorf("invalid enddelimiter '%s'", value)
+    }
+    h.endDelimiter = value
+  default:
+    h.attributes[key] = value
+  }
+  if err != nil {
+    return fmt.Errorf("invalid boolean '%s' for attribute '%s'", value, key)
+  }
+  return nil
+}
+
+// checks attributes can be given to every changeset header
+// the id is unique to each changeset so it can't have a default
+func checkDefaultAttributes(defaults map[string]string) error {
+  h := newChangesetHeader()
+  for _, key := range(sortedKeys(defaults)) {
+    name, _, ok := splitAttribute(key + ":")
+    if !ok || name == "id" {
+      return fmt.Errorf("invalid default attribute '%s'", key)
+    }
+    if err := h.set(name, defaults[key]); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// the keys of a map in order, so defaults are applied the same way every time
+func sortedKeys(m map[string]string) []string {
+  keys := make([]string, 0, len(m))
+  for key := range(m) {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// splits a header token on whitespace keeping track of where each word started
+// '--+changeset' is split in to '--+' and 'changeset'
+func splitHeader(tok *Token) []headerWord {
+  var words []headerWord
+  var current []rune
+  start := 0
+
+  for i, r := range(tok.runes) {
+    if unicode.IsSpace(r) || i == 3 && isHeader(tok.runes) {
+      if len(current) > 0 {
+        words = append(words, headerWord{string(current), tok.column + start})
+        current = nil
+      }
+      if unicode.IsSpace(r) {
+        continue
+      }
+    }
+    if len(current) == 0 {
+      start = i
+    }
+    current = append(current, r)
+  }
+  if len(current) > 0 {
+    words = append(words, headerWord{string(current), tok.column + start})
+  }
+  return words
+}
+
+// splits key:value, the key must be a simple name - anything else is a value
+func splitAttribute(word string) (string, string, bool) {
+  i := strings.Index(word, ":")
+  if i < 1 {
+    return "", "", false
+  }
+  for _, r := range(word[:i]) {
+    if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+      return "", "", false
+    }
+  }
+  return strings.ToLower(word[:i]), word[i+1:], true
+}
+
+// splits a comma separated list dropping empty entries
+func splitList(value string) []string {
+  var list []string
+  for _, item := range(strings.Split(value, ",")) {
+    item = strings.TrimSpace(item)
+    if len(item) > 0 {
+      list = append(list, item)
+    }
+  }
+  return list
+}
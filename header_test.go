@@ -0,0 +1,110 @@
+package drift
+
+import (
+  "testing"
+  "strings"
+)
+
+// scans the first token of data as a header
+func scanHeader(t *testing.T, data string) *Token {
+  s := NewScanner([]byte(data))
+  s.scanForWhitespace()
+  tok, err := s.scanForComment()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  return tok
+}
+
+func TestParseChangesetHeader(t *testing.T) {
+  data := `--+ changeset id:hello kitty author:jgilbert dbms:ql runalways:true, runonchange:true, failonerror:true`
+  h, err := parseChangesetHeader("/tmp/migration.sql", scanHeader(t, data), nil)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if h.id != "hello kitty" {
+    t.Errorf("expected '%v' got '%v'", "hello kitty", h.id)
+  }
+  if h.author != "jgilbert" {
+    t.Errorf("expected '%v' got '%v'", "jgilbert", h.author)
+  }
+  if len(h.dbms) != 1 || h.dbms[0] != "ql" {
+    t.Errorf("expected %v got %v", []string{"ql"}, h.dbms)
+  }
+  if !h.runAlways || !h.runOnChange || !h.failOnError {
+    t.Errorf("expected all flags to be set got %+v", h)
+  }
+  if len(h.attributes) != 0 {
+    t.Errorf("expected no extra attributes got %v", h.attributes)
+  }
+}
+
+func TestParseChangesetHeaderDefaults(t *testing.T) {
+  data := `--+changeset id:1`
+  h, err := parseChangesetHeader("/tmp/migration.sql", scanHeader(t, data), nil)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if h.id != "1" {
+    t.Errorf("expected '%v' got '%v'", "1", h.id)
+  }
+  if h.runAlways || h.runOnChange {
+    t.Errorf("expected runalways and runonchange to default to false")
+  }
+  if !h.failOnError {
+    t.Errorf("expected failonerror to default to true")
+  }
+  if !h.splitStatements || len(h.endDelimiter) != 0 {
+    t.Errorf("expected splitstatements to default to true and no enddelimiter")
+  }
+}
+
+func TestParseChangesetHeaderAttributes(t *testing.T) {
+  data := `--+ changeset ID:create users  dbms:postgres, mysql,  Context:dev, test FailOnError:false`
+  h, err := parseChangesetHeader("/tmp/migration.sql", scanHeader(t, data), nil)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if h.id != "create users" {
+    t.Errorf("expected '%v' got '%v'", "create users", h.id)
+  }
+  if strings.Join(h.dbms, "|") != "postgres|mysql" {
+    t.Errorf("expected %v got %v", []string{"postgres", "mysql"}, h.dbms)
+  }
+  if h.failOnError {
+    t.Errorf("expected failonerror to be false")
+  }
+  if h.attributes["context"] != "dev, test" {
+    t.Errorf("expected '%v' got '%v'", "dev, test", h.attributes["context"])
+  }
+
+  data = `--+ changeset id:1 splitStatements:false, endDelimiter:$$`
+  h, err = parseChangesetHeader("/tmp/migration.sql", scanHeader(t, data), nil)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if h.splitStatements || h.endDelimiter != "$$" {
+    t.Errorf("expected splitstatements false and enddelimiter $$ got %v %v", h.splitStatements, h.endDelimiter)
+  }
+}
+
+func TestParseChangesetHeaderBad(t *testing.T) {
+  for data, expected := range(map[string]string{
+    `--+ changeset id:1 runalways:yes`:       "/tmp/migration.sql:1:20: invalid boolean 'yes' for attribute 'runalways'",
+    `--+ changeset id:1 author:a id:2`:       "/tmp/migration.sql:1:29: duplicate attribute 'id'",
+    `  --+ changeset id:1 author:a Author:b`: "/tmp/migration.sql:1:31: duplicate attribute 'author'",
+    `--+ changeset hello id:1`:               "/tmp/migration.sql:1:15: expected key:value got 'hello'",
+    `--+ changeset author:me`:                "/tmp/migration.sql:1:1: changeset header is missing an id",
+    `--+ changeset id:, author:me`:           "/tmp/migration.sql:1:1: changeset header is missing an id",
+    `--+ changeset id:1 enddelimiter:`:       "/tmp/migration.sql:1:20: invalid enddelimiter ''",
+  }) {
+    _, err := parseChangesetHeader("/tmp/migration.sql", scanHeader(t, data), nil)
+    if err == nil {
+      t.Errorf("expected an error parsing '%v'", data)
+      continue
+    }
+    if err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err.Error())
+    }
+  }
+}
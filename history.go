@@ -0,0 +1,307 @@
+package drift
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "database/sql"
+)
+
+// the name of the history table unless the dialect or migrator says otherwise
+const DefaultHistoryTable = "drift_changelog"
+
+// A Dialect describes how drift talks to a particular database
+type Dialect struct {
+  Name             string
+  HistoryTable     string               // name of the table changesets are recorded in
+  CreateTable      string               // creates the history table, %s is the table name
+  Placeholder      func(n int) string   // the bind parameter for the nth argument starting at 1
+  Equals           string               // equality operator used in where clauses, = if empty
+  NestedComments   bool                 // /* */ comments nest, as they do in postgres
+  TransactionalDDL bool                 // ddl can be rolled back, so changesets run in a transaction
+  BackslashEscapes bool                 // a backslash escapes quotes, as it does in mysql
+
+  // count queries used by preconditions, empty if the database can't check
+  TableExists      string   // table name
+  ColumnExists     string   // table name, column name
+  AnyColumnExists  string   // column name, in any table
+  ForeignKeyExists string   // foreign key constraint name
+  IndexExists      string   // index name
+}
+
+// ? style bind parameters
+func questionPlaceholder(n int) string { return "?" }
+// $1 style bind parameters
+func dollarPlaceholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+var dialects = map[string]*Dialect{
+  "ql": &Dialect{
+    Name:             "ql",
+    HistoryTable:     DefaultHistoryTable,
+    CreateTable:      `CREATE TABLE IF NOT EXISTS %s (
+      revision string, changeset string, author string, checksum string,
+      dateexecuted time, elapsed int64, status string, orderexecuted int64
+    );`,
+    Placeholder:      dollarPlaceholder,
+    Equals:           "==",
+    TransactionalDDL: true,
+    TableExists:      "SELECT count(*) FROM __Table WHERE Name == $1",
+    ColumnExists:     "SELECT count(*) FROM __Column WHERE TableName == $1 && Name == $2",
+    AnyColumnExists:  "SELECT count(*) FROM __Column WHERE Name == $1",
+    IndexExists:      "SELECT count(*) FROM __Index WHERE Name == $1",
+  },
+  "postgres": &Dialect{
+    Name:             "postgres",
+    HistoryTable:     DefaultHistoryTable,
+    CreateTable:      `CREATE TABLE IF NOT EXISTS %s (
+      revision VARCHAR(1024) NOT NULL, changeset VARCHAR(255) NOT NULL,
+      author VARCHAR(255), checksum VARCHAR(255),
+      dateexecuted TIMESTAMP NOT NULL, elapsed BIGINT NOT NULL,
+      status VARCHAR(16) NOT NULL, orderexecuted INTEGER NOT NULL
+    )`,
+    Placeholder:      dollarPlaceholder,
+    NestedComments:   true,
+    TransactionalDDL: true,
+    TableExists:      "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1",
+    ColumnExists:     "SELECT count(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2",
+    AnyColumnExists:  "SELECT count(*) FROM information_schema.columns WHERE table_schema = current_schema() AND column_name = $1",
+    ForeignKeyExists: "SELECT count(*) FROM information_schema.table_constraints WHERE table_schema = current_schema() AND constraint_type = 'FOREIGN KEY' AND constraint_name = $1",
+    IndexExists:      "SELECT count(*) FROM pg_indexes WHERE schemaname = current_schema() AND indexname = $1",
+  },
+  "mysql": &Dialect{
+    Name:             "mysql",
+    HistoryTable:     DefaultHistoryTable,
+    CreateTable:      `CREATE TABLE IF NOT EXISTS %s (
+      revision VARCHAR(1024) NOT NULL, changeset VARCHAR(255) NOT NULL,
+      author VARCHAR(255), checksum VARCHAR(255),
+      dateexecuted DATETIME NOT NULL, elapsed BIGINT NOT NULL,
+      status VARCHAR(16) NOT NULL, orderexecuted INT NOT NULL
+    )`,
+    Placeholder:      questionPlaceholder,
+    BackslashEscapes: true,
+    TableExists:      "SELECT count(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+    ColumnExists:     "SELECT count(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?",
+    AnyColumnExists:  "SELECT count(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND column_name = ?",
+    ForeignKeyExists: "SELECT count(*) FROM information_schema.table_constraints WHERE table_schema = DATABASE() AND constraint_type = 'FOREIGN KEY' AND constraint_name = ?",
+    IndexExists:      "SELECT count(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND index_name = ?",
+  },
+  "sqlite3": &Dialect{
+    Name:             "sqlite3",
+    HistoryTable:     DefaultHistoryTable,
+    CreateTable:      `CREATE TABLE IF NOT EXISTS %s (
+      revision TEXT NOT NULL, changeset TEXT NOT NULL, author TEXT, checksum TEXT,
+      dateexecuted TIMESTAMP NOT NULL, elapsed INTEGER NOT NULL,
+      status TEXT NOT NULL, orderexecuted INTEGER NOT NULL
+    )`,
+    Placeholder:      questionPlaceholder,
+    TransactionalDDL: true,
+    TableExists:      "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+    ColumnExists:     "SELECT count(*) FROM pragma_table_info(?) WHERE name = ?",
+    IndexExists:      "SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = ?",
+  },
+}
+
+// makes a dialect available to NewMigrator under its name
+// registering a name twice replaces the earlier dialect
+func RegisterDialect(d *Dialect) {
+  dialects[strings.ToLower(d.Name)] = d
+}
+
+// returns the dialect registered under name
+// unknown databases get ? bind parameters and a portable history table
+func LookupDialect(name string) *Dialect {
+  if d, ok := dialects[strings.ToLower(name)]; ok {
+    return d
+  }
+  return &Dialect{
+    Name:         name,
+    HistoryTable: DefaultHistoryTable,
+    CreateTable:  dialects["sqlite3"].CreateTable,
+    Placeholder:  questionPlaceholder,
+  }
+}
+
+// the bind parameters for n arguments numbered from 'from'
+func (d *Dialect) placeholders(from int, n int) []string {
+  var p []string
+  for i := from; i < from + n; i++ {
+    p = append(p, d.Placeholder(i))
+  }
+  return p
+}
+
+// the equality operator with spaces either side
+func (d *Dialect) equals() string {
+  if len(d.Equals) == 0 {
+    return " = "
+  }
+  return " " + d.Equals + " "
+}
+
+// A HistoryEntry is a changeset recorded in the history table
+type HistoryEntry struct {
+  Path     string          // path of the revision the changeset is in
+  ID       string          // id of the changeset
+  Author   string
+  Checksum string
+  Executed time.Time       // when the changeset was last run
+  Duration time.Duration   // how long the changeset took to run
+  Status   Status          // outcome of the last run
+  Order    int64           // position in the order changesets were run
+}
+
+// the key a changeset is stored under
+func historyKey(path string, id string) string {
+  return path + "::" + id
+}
+
+// the history table of a database
+type history struct {
+  db      *sql.DB
+  dialect *Dialect
+  table   string
+}
+
+const historyColumns = "revision, changeset, author, checksum, dateexecuted, elapsed, status, orderexecuted"
+
+// creates the history table if it doesn't exist yet
+func (h *history) create() error {
+  return h.exec(nil, fmt.Sprintf(h.dialect.CreateTable, h.table))
+}
+
+// runs a statement against the history table inside a transaction
+// some databases (ql) only allow changes inside of a transaction
+// the statement runs in tx when it's given, otherwise in one of its own
+func (h *history) exec(tx *sql.Tx, query string, args ...interface{}) error {
+  if tx != nil {
+    _, err := tx.Exec(query, args...)
+    return err
+  }
+  tx, err := h.db.Begin()
+  if err != nil {
+    return err
+  }
+  if _, err := tx.Exec(query, args...); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+// reads every entry in the order they were run
+func (h *history) entries() ([]*HistoryEntry, error) {
+  rows, err := h.db.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY orderexecuted", historyColumns, h.table))
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var entries []*HistoryEntry
+  for rows.Next() {
+    var author, checksum, status sql.NullString
+    var elapsed int64
+    e := &HistoryEntry{}
+    err := rows.Scan(&e.Path, &e.ID, &author, &checksum, executedTime{&e.Executed}, &elapsed, &status, &e.Order)
+    if err != nil {
+      return nil, err
+    }
+    e.Author = author.String
+    e.Checksum = checksum.String
+    e.Duration = time.Duration(elapsed) * time.Millisecond
+    e.Status, err = parseStatus(status.String)
+    if err != nil {
+      return nil, err
+    }
+    entries = append(entries, e)
+  }
+  return entries, rows.Err()
+}
+
+// scans dateexecuted, which drivers that don't parse times return as text
+// e.g. mysql without parseTime=true in the dsn
+// text without a zone is taken to be utc, as the mysql driver writes it
+type executedTime struct {
+  t *time.Time
+}
+
+// the layouts dateexecuted is written in as text
+var executedLayouts = []string{
+  "2006-01-02 15:04:05.999999999Z07:00",
+  "2006-01-02T15:04:05.999999999Z07:00",
+  "2006-01-02 15:04:05.999999999",
+  "2006-01-02 15:04:05.999999999 -0700 MST",
+}
+
+func (e executedTime) Scan(value interface{}) error {
+  var text string
+  switch v := value.(type) {
+  case time.Time:
+    *e.t = v
+    return nil
+  case nil:
+    *e.t = time.Time{}
+    return nil
+  case []byte:
+    text = string(v)
+  case string:
+    text = v
+  default:
+    return fmt.Errorf("can't read dateexecuted %v of type %T", value, value)
+  }
+  for _, layout := range(executedLayouts) {
+    if t, err := time.ParseInLocation(layout, text, time.UTC); err == nil {
+      *e.t = t
+      return nil
+    }
+  }
+  return fmt.Errorf("can't read dateexecuted '%s'", text)
+}
+
+// matches the entry for a revision path and changeset id
+func (h *history) where(path string, id string) string {
+  eq := h.dialect.equals()
+  return "revision" + eq + path + " AND changeset" + eq + id
+}
+
+// writes an entry, overwriting the changeset's existing entry if it has one
+// the entry is written in tx when it's given
+func (h *history) save(tx *sql.Tx, e *HistoryEntry, exists bool) error {
+  if exists {
+    return h.update(tx, e)
+  }
+  return h.insert(tx, e)
+}
+
+// adds a new entry
+func (h *history) insert(tx *sql.Tx, e *HistoryEntry) error {
+  query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+    h.table, historyColumns, strings.Join(h.dialect.placeholders(1, 8), ", "))
+  return h.exec(tx, query, e.Path, e.ID, e.Author, e.Checksum, e.Executed,
+    int64(e.Duration / time.Millisecond), e.Status.String(), e.Order)
+}
+
+// overwrites the entry for the same revision path and changeset id
+func (h *history) update(tx *sql.Tx, e *HistoryEntry) error {
+  p := h.dialect.placeholders(1, 8)
+  query := fmt.Sprintf("UPDATE %s SET author = %s, checksum = %s, dateexecuted = %s, elapsed = %s, status = %s, orderexecuted = %s WHERE %s",
+    h.table, p[0], p[1], p[2], p[3], p[4], p[5], h.where(p[6], p[7]))
+  return h.exec(tx, query, e.Author, e.Checksum, e.Executed,
+    int64(e.Duration / time.Millisecond), e.Status.String(), e.Order, e.Path, e.ID)
+}
+
+// removes the entry for a revision path and changeset id
+func (h *history) delete(tx *sql.Tx, path string, id string) error {
+  p := h.dialect.placeholders(1, 2)
+  query := fmt.Sprintf("DELETE FROM %s WHERE %s", h.table, h.where(p[0], p[1]))
+  return h.exec(tx, query, path, id)
+}
+
+// turns a status read from the history table back in to a Status
+func parseStatus(s string) (Status, error) {
+  for _, status := range([]Status{Executed, Failed, Skipped, Reexecuted, RolledBack, MarkedRan, Partial}) {
+    if status.String() == s {
+      return status, nil
+    }
+  }
+  return Failed, fmt.Errorf("unknown changeset status '%s'", s)
+}
@@ -0,0 +1,115 @@
+package drift
+
+import (
+  "time"
+  "strings"
+  "testing"
+)
+
+func TestLookupDialect(t *testing.T) {
+  for name, expected := range(map[string]string{
+    "ql":       "$1 $2",
+    "Postgres": "$1 $2",
+    "mysql":    "? ?",
+    "sqlite3":  "? ?",
+    "oracle":   "? ?",
+  }) {
+    d := LookupDialect(name)
+    if got := strings.Join(d.placeholders(1, 2), " "); got != expected {
+      t.Errorf("%v: expected '%v' got '%v'", name, expected, got)
+    }
+    if d.HistoryTable != DefaultHistoryTable {
+      t.Errorf("%v: expected %v got %v", name, DefaultHistoryTable, d.HistoryTable)
+    }
+    if !strings.HasPrefix(d.CreateTable, "CREATE TABLE IF NOT EXISTS %s") {
+      t.Errorf("%v: unexpected create table '%v'", name, d.CreateTable)
+    }
+  }
+}
+
+func TestRegisterDialect(t *testing.T) {
+  d := &Dialect{
+    Name:         "Custom",
+    HistoryTable: "changes",
+    CreateTable:  "CREATE TABLE IF NOT EXISTS %s ()",
+    Placeholder:  func(n int) string { return ":p" },
+  }
+  RegisterDialect(d)
+  defer delete(dialects, "custom")
+  if LookupDialect("custom") != d {
+    t.Errorf("expected the registered dialect")
+  }
+}
+
+func TestHistoryWhere(t *testing.T) {
+  for name, expected := range(map[string]string{
+    "ql":       "revision == $1 AND changeset == $2",
+    "postgres": "revision = $1 AND changeset = $2",
+  }) {
+    d := LookupDialect(name)
+    h := &history{nil, d, DefaultHistoryTable}
+    p := d.placeholders(1, 2)
+    if got := h.where(p[0], p[1]); got != expected {
+      t.Errorf("%v: expected '%v' got '%v'", name, expected, got)
+    }
+  }
+}
+
+func TestParseStatus(t *testing.T) {
+  for _, status := range([]Status{Executed, Failed, Skipped, Reexecuted, RolledBack, MarkedRan, Partial}) {
+    parsed, err := parseStatus(status.String())
+    if err != nil || parsed != status {
+      t.Errorf("expected %v got %v %v", status, parsed, err)
+    }
+  }
+  if _, err := parseStatus("RAN"); err == nil {
+    t.Errorf("expected an error parsing an unknown status")
+  }
+}
+
+// drivers that don't parse times return dateexecuted as text
+func TestExecutedTime(t *testing.T) {
+  when := time.Date(2024, 3, 1, 12, 30, 15, 0, time.UTC)
+  for _, value := range([]struct{
+    value    interface{}
+    expected time.Time
+  }{
+    {when, when},
+    {[]byte("2024-03-01 12:30:15"), when},
+    {"2024-03-01 12:30:15.25", when.Add(250 * time.Millisecond)},
+    {"2024-03-01 14:30:15+02:00", when},
+    {"2024-03-01T12:30:15Z", when},
+    {"2024-03-01 12:30:15 +0000 UTC", when},
+    {nil, time.Time{}},
+  }) {
+    var got time.Time
+    if err := (executedTime{&got}).Scan(value.value); err != nil || !got.Equal(value.expected) {
+      t.Errorf("%v: expected %v got %v %v", value.value, value.expected, got, err)
+    }
+  }
+  for _, value := range([]interface{}{"yesterday", int64(1)}) {
+    var got time.Time
+    if err := (executedTime{&got}).Scan(value); err == nil {
+      t.Errorf("%v: expected an error", value)
+    }
+  }
+}
+
+func TestHistoryTextTimes(t *testing.T) {
+  db, fake := newFakeDB(t)
+  m := NewMigrator(db, "mysql", &Revision{data: []byte("--+ changeset id:1\nSELECT 1;"), path: "/tmp/1.sql"})
+  if _, err := m.Migrate(); err != nil {
+    t.Fatal(err)
+  }
+  fake.history[0][4] = []byte("2024-03-01 12:30:15")
+  entries, err := m.History()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(entries) != 1 || !entries[0].Executed.Equal(time.Date(2024, 3, 1, 12, 30, 15, 0, time.UTC)) {
+    t.Errorf("unexpected entries %+v", entries)
+  }
+  if _, err := m.Migrate(); err != nil {
+    t.Errorf("unexpected error %v", err)
+  }
+}
@@ -0,0 +1,165 @@
+package drift
+
+import (
+  "path"
+  "strings"
+)
+
+// an '--+ include' or '--+ includeAll' header
+// e.g. --+ include path:tables/users.sql
+//      --+ includeAll path:views/ patterns:*.sql
+type include struct {
+  path     string     // relative to the including revision unless absolute
+  all      bool       // include every revision under the path
+  patterns []string   // what includeAll reads, see ReadRevisions
+  line     int
+  column   int
+}
+
+// parses an include or includeAll header
+func parseInclude(p string, tok *Token) (include, error) {
+  inc := include{
+    all:    strings.EqualFold(headerName(tok.runes), "includeall"),
+    line:   tok.lineno,
+    column: tok.column,
+  }
+  attrs, err := parseAttributes(p, tok, headerArguments(tok))
+  if err != nil {
+    return inc, err
+  }
+  for _, attr := range(attrs) {
+    switch {
+    case attr.key == "path":
+      inc.path = attr.value
+    case attr.key == "patterns" && inc.all:
+      inc.patterns = splitList(attr.value)
+      for _, pattern := range(inc.patterns) {
+        if _, err := path.Match(pattern, ""); err != nil {
+          return inc, newParseError(p, tok.lineno, attr.column, "invalid pattern '%s'", pattern)
+        }
+      }
+    default:
+      return inc, newParseError(p, tok.lineno, attr.column, "unknown attribute '%s'", attr.key)
+    }
+  }
+  if len(inc.path) == 0 {
+    return inc, newParseError(p, tok.lineno, tok.column, "%s is missing a path", headerName(tok.runes))
+  }
+  return inc, nil
+}
+
+// test for the include headers
+func isInclude(name string) bool {
+  return strings.EqualFold(name, "include") || strings.EqualFold(name, "includeall")
+}
+
+// the include headers at the top of a revision, before its first changeset
+func parseIncludes(rev *Revision) ([]include, error) {
+  r, err := rev.Changesets()
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  p := r.p
+  for !p.done && !p.started {
+    p.step()
+  }
+  if len(p.errors) > 0 {
+    return nil, p.errors
+  }
+  return p.includes, nil
+}
+
+// Reads a revision along with every revision it includes, in the order they
+// should be applied
+// '--+ include path:<file>' and '--+ includeAll path:<dir>' headers before the
+// first changeset pull in other revisions, paths are relative to the revision
+// including them, includeAll reads a directory like ReadRevisions
+// included revisions come before the revision including them, in the order
+// they're included, a revision included more than once is only read the first
+// time
+// include cycles and missing revisions are ParseErrors at the include header
+// e.g. ReadChangelog('migrations/master.sql', OSFileSystem{})
+func ReadChangelog(p string, fs FileSystem) ([]*Revision, error) {
+  c := &changelog{fs: fs, seen: make(map[string]bool)}
+  if err := c.read(path.Clean(p), nil, include{}); err != nil {
+    return nil, err
+  }
+  return c.revisions, nil
+}
+
+// the state of reading a changelog
+type changelog struct {
+  fs        FileSystem
+  stack     []string          // the revisions being read, each including the next
+  seen      map[string]bool   // revisions already read
+  revisions []*Revision
+}
+
+// reads a revision and the revisions it includes
+// from is the revision including it with the include header inc, nil for the
+// root of the changelog
+func (c *changelog) read(p string, from *Revision, inc include) error {
+  for i, s := range(c.stack) {
+    if s == p {
+      cycle := append(append([]string(nil), c.stack[i:]...), p)
+      return c.errorAt(from, inc, "include cycle %s", strings.Join(cycle, " -> "))
+    }
+  }
+  if c.seen[p] {
+    return nil
+  }
+  rev, err := ReadRevision(p, c.fs)
+  if err != nil {
+    if from == nil {
+      return err
+    }
+    return c.errorAt(from, inc, "can't include %s: %v", p, err)
+  }
+  c.seen[p] = true
+  includes, err := parseIncludes(rev)
+  if err != nil {
+    return err
+  }
+
+  c.stack = append(c.stack, p)
+  for _, inc := range(includes) {
+    target := inc.path
+    if !path.IsAbs(target) {
+      target = path.Join(path.Dir(p), target)
+    }
+    if !inc.all {
+      if err := c.read(target, rev, inc); err != nil {
+        return err
+      }
+      continue
+    }
+    patterns := inc.patterns
+    if len(patterns) == 0 {
+      patterns = DefaultRevisionPatterns
+    }
+    paths, err := findRevisions(target, c.fs, patterns)
+    if err != nil {
+      return c.errorAt(rev, inc, "can't include %s: %v", target, err)
+    }
+    for _, found := range(paths) {
+      // a revision including its own directory doesn't include itself
+      if found == p {
+        continue
+      }
+      if err := c.read(found, rev, inc); err != nil {
+        return err
+      }
+    }
+  }
+  c.stack = c.stack[:len(c.stack) - 1]
+  c.revisions = append(c.revisions, rev)
+  return nil
+}
+
+// an error at an include header
+func (c *changelog) errorAt(rev *Revision, inc include, format string, args ...interface{}) error {
+  err := newParseError(rev.path, inc.line, inc.column, format, args...)
+  err.Snippet = lineOf(rev.data, inc.line)
+  return ParseErrors{err}
+}
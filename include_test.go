@@ -0,0 +1,129 @@
+package drift
+
+import (
+  "strings"
+  "testing"
+)
+
+// a filesystem of revisions keyed by path
+func includeFS(revisions map[string]string) *MemFS {
+  fs := NewMemFS()
+  for p, data := range(revisions) {
+    fs.WriteFile(p, []byte(data), 0644)
+  }
+  return fs
+}
+
+// the paths of revisions joined with |
+func revisionPaths(revisions []*Revision) string {
+  var paths []string
+  for _, rev := range(revisions) {
+    paths = append(paths, rev.Path())
+  }
+  return strings.Join(paths, "|")
+}
+
+func TestReadChangelog(t *testing.T) {
+  fs := includeFS(map[string]string{
+    "/db/master.sql": `-- the whole database
+--+ include path:tables/users.sql
+--+ includeAll path:views/
+--+ include path:/db/tables/users.sql
+--+ includeAll path:. patterns:*.ddl
+
+--+ changeset id:grants
+GRANT ALL ON users TO app;`,
+    "/db/tables/users.sql":  "--+ include path:types.sql\n--+ changeset id:1\nCREATE TABLE users (id int);",
+    "/db/tables/types.sql":  "--+ changeset id:1\nCREATE TYPE t AS (id int);",
+    "/db/views/v10.sql":     "--+ changeset id:1\nCREATE VIEW v10 AS SELECT 10;",
+    "/db/views/v2.sql":      "--+ include path:../tables/types.sql\n--+ changeset id:1\nCREATE VIEW v2 AS SELECT 2;",
+    "/db/views/README.md":   "not a revision",
+    "/db/extra.ddl":         "--+ changeset id:1\nSELECT 1;",
+  })
+  revisions, err := ReadChangelog("/db/./master.sql", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := "/db/tables/types.sql|/db/tables/users.sql|/db/views/v2.sql|/db/views/v10.sql|/db/extra.ddl|/db/master.sql"
+  if revisionPaths(revisions) != expected {
+    t.Errorf("expected %v got %v", expected, revisionPaths(revisions))
+  }
+  // the master revision still parses on its own
+  changesets, err := ParseChangesets(revisions[len(revisions) - 1])
+  if err != nil || len(changesets) != 1 || changesets[0].ID() != "grants" {
+    t.Errorf("expected the grants changeset got %v %v", changesets, err)
+  }
+}
+
+// a revision can includeAll its own directory without including itself
+func TestReadChangelogIncludeAllSelf(t *testing.T) {
+  fs := includeFS(map[string]string{
+    "/db/master.sql": "--+ includeAll path:./",
+    "/db/1.sql":      "--+ changeset id:1\nSELECT 1;",
+    "/db/2.sql":      "--+ changeset id:1\nSELECT 2;",
+  })
+  revisions, err := ReadChangelog("/db/master.sql", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revisionPaths(revisions) != "/db/1.sql|/db/2.sql|/db/master.sql" {
+    t.Errorf("unexpected revisions %v", revisionPaths(revisions))
+  }
+}
+
+func TestReadChangelogBad(t *testing.T) {
+  for _, value := range([]struct{
+    revisions map[string]string
+    expected  string
+    snippet   string
+  }{
+    {map[string]string{
+      "/db/a.sql": "--+ include path:b.sql",
+      "/db/b.sql": "-- b\n--+ include path:c.sql",
+      "/db/c.sql": "  --+ include path:a.sql",
+    }, "/db/c.sql:1:3: include cycle /db/a.sql -> /db/b.sql -> /db/c.sql -> /db/a.sql", "  --+ include path:a.sql"},
+    {map[string]string{
+      "/db/a.sql": "--+ include path:a.sql",
+    }, "/db/a.sql:1:1: include cycle /db/a.sql -> /db/a.sql", "--+ include path:a.sql"},
+    {map[string]string{
+      "/db/a.sql": "--+ include path:b.sql\n--+ include path:missing.sql",
+      "/db/b.sql": "--+ changeset id:1\nSELECT 1;",
+    }, "/db/a.sql:2:1: can't include /db/missing.sql: open /db/missing.sql: file does not exist", "--+ include path:missing.sql"},
+    {map[string]string{
+      "/db/a.sql": "--+ includeAll path:nowhere/",
+    }, "/db/a.sql:1:1: can't include /db/nowhere: readdir /db/nowhere: file does not exist", "--+ includeAll path:nowhere/"},
+    {map[string]string{
+      "/db/a.sql": "--+ include file:b.sql",
+    }, "/db/a.sql:1:13: unknown attribute 'file'", "--+ include file:b.sql"},
+    {map[string]string{
+      "/db/a.sql": "--+ include path:b.sql patterns:*.sql",
+    }, "/db/a.sql:1:24: unknown attribute 'patterns'", "--+ include path:b.sql patterns:*.sql"},
+    {map[string]string{
+      "/db/a.sql": "--+ includeAll patterns:*.sql",
+    }, "/db/a.sql:1:1: includeAll is missing a path", "--+ includeAll patterns:*.sql"},
+  }) {
+    _, err := ReadChangelog("/db/a.sql", includeFS(value.revisions))
+    errs, ok := err.(ParseErrors)
+    if !ok || err.Error() != value.expected {
+      t.Errorf("expected '%v' got '%v'", value.expected, err)
+      continue
+    }
+    if errs[0].Snippet != value.snippet {
+      t.Errorf("expected snippet '%v' got '%v'", value.snippet, errs[0].Snippet)
+    }
+  }
+
+  if _, err := ReadChangelog("/db/missing.sql", includeFS(nil)); err == nil {
+    t.Errorf("expected a missing changelog to error")
+  }
+}
+
+// includes only belong at the top of a revision
+func TestParseChangesetsInclude(t *testing.T) {
+  data := "--+ include path:a.sql\n--+ changeset id:1\nSELECT 1;\n--+ include path:b.sql\n"
+  _, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/1.sql"})
+  expected := "/tmp/1.sql:4:1: include found after the first changeset"
+  if err == nil || err.Error() != expected {
+    t.Errorf("expected '%v' got '%v'", expected, err)
+  }
+}
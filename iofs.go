@@ -0,0 +1,164 @@
+package drift
+
+import (
+  "io"
+  "os"
+  "path"
+  "bytes"
+  "io/fs"
+  "strings"
+  "io/ioutil"
+)
+
+// FromIOFS makes an fs.FS (embed.FS, fstest.MapFS, os.DirFS...) a FileSystem
+// so revisions compiled in to a binary with //go:embed can be read
+// fs.FS paths are relative, so leading slashes are dropped and '/' or ''
+// are the root
+// files that can't seek or read at an offset are read in to memory when
+// they're opened
+// e.g. //go:embed migrations
+//      var migrations embed.FS
+//      revs, err := ReadRevisions("migrations", FromIOFS(migrations))
+func FromIOFS(fsys fs.FS) FileSystem {
+  return ioFileSystem{fsys}
+}
+
+// an fs.FS as a FileSystem
+type ioFileSystem struct {
+  fsys fs.FS
+}
+
+// the fs.FS name of a drift path
+func ioPath(name string) string {
+  p := strings.TrimPrefix(path.Clean("/" + name), "/")
+  if len(p) == 0 {
+    return "."
+  }
+  return p
+}
+
+func (i ioFileSystem) Open(name string) (File, error) {
+  f, err := i.fsys.Open(ioPath(name))
+  if err != nil {
+    return nil, err
+  }
+  if file, ok := f.(File); ok {
+    return file, nil
+  }
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, err
+  }
+  var data []byte
+  if !info.IsDir() {
+    data, err = ioutil.ReadAll(f)
+  }
+  f.Close()
+  if err != nil {
+    return nil, err
+  }
+  return &memHandle{bytes.NewReader(data), info}, nil
+}
+
+func (i ioFileSystem) Stat(name string) (os.FileInfo, error) {
+  return fs.Stat(i.fsys, ioPath(name))
+}
+
+func (i ioFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+  entries, err := fs.ReadDir(i.fsys, ioPath(name))
+  if err != nil {
+    return nil, err
+  }
+  infos := make([]os.FileInfo, 0, len(entries))
+  for _, entry := range(entries) {
+    info, err := entry.Info()
+    if err != nil {
+      return nil, err
+    }
+    infos = append(infos, info)
+  }
+  return infos, nil
+}
+
+// ToIOFS makes a FileSystem an fs.FS, so it can be used by anything taking
+// one (fs.WalkDir, http.FS, template.ParseFS...)
+// names are the unrooted, slash separated paths fs.FS uses and are passed to
+// the FileSystem as they are, '.' is passed as '.'
+func ToIOFS(fsys FileSystem) fs.FS {
+  return driftFS{fsys}
+}
+
+// a FileSystem as an fs.FS
+type driftFS struct {
+  fsys FileSystem
+}
+
+func (d driftFS) Open(name string) (fs.File, error) {
+  if !fs.ValidPath(name) {
+    return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+  }
+  f, err := d.fsys.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  return &driftFile{File: f, fsys: d.fsys, name: name}, nil
+}
+
+func (d driftFS) Stat(name string) (fs.FileInfo, error) {
+  if !fs.ValidPath(name) {
+    return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+  }
+  return d.fsys.Stat(name)
+}
+
+func (d driftFS) ReadDir(name string) ([]fs.DirEntry, error) {
+  if !fs.ValidPath(name) {
+    return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+  }
+  infos, err := d.fsys.ReadDir(name)
+  if err != nil {
+    return nil, err
+  }
+  entries := make([]fs.DirEntry, 0, len(infos))
+  for _, info := range(infos) {
+    entries = append(entries, fs.FileInfoToDirEntry(info))
+  }
+  return entries, nil
+}
+
+// a File opened through ToIOFS, directories can be listed with ReadDir
+type driftFile struct {
+  File
+  fsys    FileSystem
+  name    string
+  entries []fs.DirEntry   // what's left to list
+  listed  bool            // entries has been read
+}
+
+// lists the directory n entries at a time, all of them if n <= 0, like
+// fs.ReadDirFile
+func (f *driftFile) ReadDir(n int) ([]fs.DirEntry, error) {
+  if !f.listed {
+    entries, err := driftFS{f.fsys}.ReadDir(f.name)
+    if err != nil {
+      return nil, err
+    }
+    f.entries = entries
+    f.listed = true
+  }
+  if n <= 0 {
+    entries := f.entries
+    f.entries = nil
+    return entries, nil
+  }
+  if len(f.entries) == 0 {
+    return nil, io.EOF
+  }
+  if n > len(f.entries) {
+    n = len(f.entries)
+  }
+  entries := f.entries[:n]
+  f.entries = f.entries[n:]
+  return entries, nil
+}
@@ -0,0 +1,127 @@
+package drift
+
+import (
+  "io"
+  "os"
+  "errors"
+  "testing"
+  "io/fs"
+  "testing/fstest"
+)
+
+// an fs.FS file without ReadAt or Seek
+type plainFS struct{ fstest.MapFS }
+type plainFile struct{ fs.File }
+func (p plainFS) Open(name string) (fs.File, error) {
+  f, err := p.MapFS.Open(name)
+  if err != nil {
+    return nil, err
+  }
+  return plainFile{f}, nil
+}
+
+func TestFromIOFS(t *testing.T) {
+  files := fstest.MapFS{
+    "db/V2.sql":       &fstest.MapFile{Data: []byte("--+ changeset id:2\nSELECT 2;")},
+    "db/V1.sql":       &fstest.MapFile{Data: []byte("--+ changeset id:1\nSELECT 1;")},
+    "db/views/v1.sql": &fstest.MapFile{Data: []byte("--+ changeset id:1\nSELECT 3;")},
+    "db/README.md":    &fstest.MapFile{Data: []byte("not a revision")},
+  }
+  for _, fsys := range([]fs.FS{files, plainFS{files}}) {
+    rfs := FromIOFS(fsys)
+    revisions, err := ReadRevisions("/db", rfs)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if revisionPaths(revisions) != "/db/V1.sql|/db/V2.sql|/db/views/v1.sql" {
+      t.Errorf("unexpected revisions %v", revisionPaths(revisions))
+    }
+    if string(revisions[0].Data()) != "--+ changeset id:1\nSELECT 1;" {
+      t.Errorf("unexpected revision data %q", revisions[0].Data())
+    }
+
+    // streamed revisions seek back to the start on every parse
+    rev, err := OpenRevision("db/V2.sql", rfs)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for i := 0; i < 2; i++ {
+      changesets, err := ParseChangesets(rev)
+      if err != nil || len(changesets) != 1 || changesets[0].SQL() != "SELECT 2;" {
+        t.Errorf("unexpected changesets %v %v", changesets, err)
+      }
+    }
+
+    f, err := rfs.Open("db/V1.sql")
+    if err != nil {
+      t.Fatal(err)
+    }
+    out := make([]byte, 9)
+    if _, err := f.ReadAt(out, 19); err != nil || string(out) != "SELECT 1;" {
+      t.Errorf("expected %q got %q %v", "SELECT 1;", out, err)
+    }
+    f.Close()
+    if info, err := rfs.Stat("/"); err != nil || !info.IsDir() {
+      t.Errorf("expected the root to be a directory got %v %v", info, err)
+    }
+    if _, err := rfs.Open("/db/V3.sql"); !errors.Is(err, os.ErrNotExist) {
+      t.Errorf("expected a missing file to not exist got %v", err)
+    }
+  }
+}
+
+func TestToIOFS(t *testing.T) {
+  mem := NewMemFS()
+  mem.WriteFile("db/V1.sql", []byte("--+ changeset id:1\nSELECT 1;"), 0644)
+  mem.WriteFile("db/V2.sql", []byte("--+ changeset id:2\nSELECT 2;"), 0644)
+  mem.WriteFile("db/views/v1.sql", []byte("--+ changeset id:1\nSELECT 3;"), 0644)
+  fsys := ToIOFS(mem)
+  if err := fstest.TestFS(fsys, "db/V1.sql", "db/V2.sql", "db/views/v1.sql"); err != nil {
+    t.Fatal(err)
+  }
+
+  out, err := fs.ReadFile(fsys, "db/V2.sql")
+  if err != nil || string(out) != "--+ changeset id:2\nSELECT 2;" {
+    t.Errorf("unexpected file %q %v", out, err)
+  }
+  var walked []string
+  fs.WalkDir(fsys, "db", func(p string, d fs.DirEntry, err error) error {
+    walked = append(walked, p)
+    return err
+  })
+  if len(walked) != 5 || walked[4] != "db/views/v1.sql" {
+    t.Errorf("unexpected walk %v", walked)
+  }
+  if _, err := fsys.Open("/db/V1.sql"); !errors.Is(err, fs.ErrInvalid) {
+    t.Errorf("expected a rooted name to be invalid got %v", err)
+  }
+
+  // directories are listed a few entries at a time
+  f, _ := fsys.Open("db")
+  dir := f.(fs.ReadDirFile)
+  var names []string
+  for {
+    entries, err := dir.ReadDir(2)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, entry := range(entries) {
+      names = append(names, entry.Name())
+    }
+  }
+  if len(names) != 3 || names[2] != "views" {
+    t.Errorf("unexpected entries %v", names)
+  }
+
+  // round tripping goes back to the same files
+  revisions, err := ReadRevisions("db", FromIOFS(fsys))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revisionPaths(revisions) != "db/V1.sql|db/V2.sql|db/views/v1.sql" {
+    t.Errorf("unexpected revisions %v", revisionPaths(revisions))
+  }
+}
@@ -0,0 +1,212 @@
+package drift
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "path"
+  "sort"
+  "sync"
+  "time"
+  "bytes"
+  "strings"
+)
+
+// MemFS is a FileSystem held in memory, for building revisions in code and
+// testing migrations without touching the disk
+// paths are slash separated, relative paths are relative to the root so
+// 'db/1.sql' and '/db/1.sql' are the same file
+// directories are made as files are written to them
+// e.g. fs := NewMemFS()
+//      fs.WriteFile("migrations/1.sql", []byte(sql), 0644)
+//      revs, err := ReadRevisions("migrations", fs)
+type MemFS struct {
+  mu    sync.RWMutex
+  files map[string]*memFile   // keyed by clean absolute path
+}
+
+// a file or directory in a MemFS
+type memFile struct {
+  name    string
+  data    []byte
+  mode    os.FileMode
+  modtime time.Time
+}
+
+func NewMemFS() *MemFS {
+  return &MemFS{files: map[string]*memFile{
+    "/": &memFile{name: "/", mode: os.ModeDir | 0755, modtime: time.Now()},
+  }}
+}
+
+// the key a path is stored under
+func memPath(name string) string {
+  return path.Clean("/" + name)
+}
+
+// an error for a path like the os package gives
+func memError(op string, name string, err error) error {
+  return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// writes a file, replacing it if it exists, and makes any missing directories
+// the data is copied
+func (m *MemFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+  return m.write(name, data, perm, time.Now())
+}
+
+func (m *MemFS) write(name string, data []byte, perm os.FileMode, modtime time.Time) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  p := memPath(name)
+  if f, ok := m.files[p]; ok && f.mode.IsDir() {
+    return memError("write", name, fmt.Errorf("is a directory"))
+  }
+  if err := m.mkdirAll(path.Dir(p), 0755); err != nil {
+    return memError("write", name, err)
+  }
+  m.files[p] = &memFile{
+    name:    path.Base(p),
+    data:    append([]byte(nil), data...),
+    mode:    perm.Perm(),
+    modtime: modtime,
+  }
+  return nil
+}
+
+// makes a directory along with any missing parents
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if err := m.mkdirAll(memPath(name), perm); err != nil {
+    return memError("mkdir", name, err)
+  }
+  return nil
+}
+
+func (m *MemFS) mkdirAll(p string, perm os.FileMode) error {
+  if f, ok := m.files[p]; ok {
+    if !f.mode.IsDir() {
+      return fmt.Errorf("%s is not a directory", p)
+    }
+    return nil
+  }
+  if err := m.mkdirAll(path.Dir(p), perm); err != nil {
+    return err
+  }
+  m.files[p] = &memFile{name: path.Base(p), mode: os.ModeDir | perm.Perm(), modtime: time.Now()}
+  return nil
+}
+
+// removes a file or an empty directory
+func (m *MemFS) Remove(name string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  p := memPath(name)
+  f, ok := m.files[p]
+  if !ok {
+    return memError("remove", name, os.ErrNotExist)
+  }
+  if f.mode.IsDir() && len(m.children(p)) > 0 {
+    return memError("remove", name, fmt.Errorf("directory not empty"))
+  }
+  if p == "/" {
+    return memError("remove", name, os.ErrInvalid)
+  }
+  delete(m.files, p)
+  return nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  f, ok := m.files[memPath(name)]
+  if !ok {
+    return nil, memError("open", name, os.ErrNotExist)
+  }
+  // files are never changed in place so the reader sees the data as it was
+  // when it was opened
+  return &memHandle{bytes.NewReader(f.data), f.info()}, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  f, ok := m.files[memPath(name)]
+  if !ok {
+    return nil, memError("stat", name, os.ErrNotExist)
+  }
+  return f.info(), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  p := memPath(name)
+  f, ok := m.files[p]
+  if !ok {
+    return nil, memError("readdir", name, os.ErrNotExist)
+  }
+  if !f.mode.IsDir() {
+    return nil, memError("readdir", name, fmt.Errorf("not a directory"))
+  }
+  var infos []os.FileInfo
+  for _, child := range(m.children(p)) {
+    infos = append(infos, child.info())
+  }
+  sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+  return infos, nil
+}
+
+// the files and directories directly inside a directory
+func (m *MemFS) children(dir string) []*memFile {
+  prefix := strings.TrimSuffix(dir, "/") + "/"
+  var children []*memFile
+  for p, f := range(m.files) {
+    if p != dir && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+      children = append(children, f)
+    }
+  }
+  return children
+}
+
+func (f *memFile) info() os.FileInfo {
+  return &memFileInfo{f.name, int64(len(f.data)), f.mode, f.modtime}
+}
+
+// the contents of an open file
+type contents interface {
+  io.Reader
+  io.ReaderAt
+  io.Seeker
+}
+
+// an open MemFS file, or any other file whose contents are already at hand
+type memHandle struct {
+  contents
+  info os.FileInfo
+}
+
+func (h *memHandle) Close() error { return nil }
+func (h *memHandle) Stat() (os.FileInfo, error) { return h.info, nil }
+func (h *memHandle) Read(p []byte) (int, error) {
+  if h.info.IsDir() {
+    return 0, memError("read", h.info.Name(), fmt.Errorf("is a directory"))
+  }
+  return h.contents.Read(p)
+}
+
+// the os.FileInfo of a MemFS file
+type memFileInfo struct {
+  name    string
+  size    int64
+  mode    os.FileMode
+  modtime time.Time
+}
+
+func (i *memFileInfo) Name() string { return i.name }
+func (i *memFileInfo) Size() int64 { return i.size }
+func (i *memFileInfo) Mode() os.FileMode { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modtime }
+func (i *memFileInfo) IsDir() bool { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{} { return nil }
@@ -0,0 +1,146 @@
+package drift
+
+import (
+  "os"
+  "errors"
+  "testing"
+  "io/ioutil"
+)
+
+func TestMemFS(t *testing.T) {
+  fs := NewMemFS()
+  data := []byte("--+ changeset id:1\nSELECT 1;")
+  if err := fs.WriteFile("db/V1.sql", data, 0644); err != nil {
+    t.Fatal(err)
+  }
+  // the data is copied
+  data[0] = 'x'
+
+  // relative and absolute paths are the same file
+  for _, p := range([]string{"db/V1.sql", "/db/V1.sql", "/db/../db/./V1.sql"}) {
+    f, err := fs.Open(p)
+    if err != nil {
+      t.Fatal(err)
+    }
+    out, _ := ioutil.ReadAll(f)
+    if string(out) != "--+ changeset id:1\nSELECT 1;" {
+      t.Errorf("expected the revision got %q", out)
+    }
+    f.Close()
+  }
+
+  info, err := fs.Stat("/db/V1.sql")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if info.Name() != "V1.sql" || info.Size() != int64(len(data)) || info.IsDir() || info.Mode() != 0644 {
+    t.Errorf("unexpected file info %v %v %v %v", info.Name(), info.Size(), info.IsDir(), info.Mode())
+  }
+  if info, err = fs.Stat("/db"); err != nil || !info.IsDir() {
+    t.Errorf("expected /db to be a directory got %v %v", info, err)
+  }
+
+  if _, err := fs.Open("/db/V2.sql"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing file to not exist got %v", err)
+  }
+  if _, err := fs.Stat("/nowhere"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing file to not exist got %v", err)
+  }
+  // files can't be written over directories or used as them
+  if err := fs.WriteFile("/db", nil, 0644); err == nil {
+    t.Errorf("expected writing over a directory to error")
+  }
+  if err := fs.WriteFile("/db/V1.sql/a.sql", nil, 0644); err == nil {
+    t.Errorf("expected writing under a file to error")
+  }
+}
+
+func TestMemFSReadDir(t *testing.T) {
+  fs := NewMemFS()
+  fs.WriteFile("/db/V2.sql", nil, 0644)
+  fs.WriteFile("/db/V1.sql", nil, 0644)
+  fs.WriteFile("/db/views/v1.sql", nil, 0644)
+  fs.WriteFile("/dbx/V1.sql", nil, 0644)
+  fs.MkdirAll("/db/empty", 0755)
+
+  infos, err := fs.ReadDir("/db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  var names []string
+  for _, info := range(infos) {
+    name := info.Name()
+    if info.IsDir() {
+      name += "/"
+    }
+    names = append(names, name)
+  }
+  if len(names) != 4 || names[0] != "V1.sql" || names[1] != "V2.sql" || names[2] != "empty/" || names[3] != "views/" {
+    t.Errorf("unexpected entries %v", names)
+  }
+  if infos, err := fs.ReadDir("/"); err != nil || len(infos) != 2 {
+    t.Errorf("expected the root to hold db and dbx got %v %v", infos, err)
+  }
+  if _, err := fs.ReadDir("/db/V1.sql"); err == nil {
+    t.Errorf("expected reading a file as a directory to error")
+  }
+  if _, err := fs.ReadDir("/nowhere"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing directory to not exist got %v", err)
+  }
+
+  revisions, err := ReadRevisions("db", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revisionPaths(revisions) != "db/V1.sql|db/V2.sql|db/views/v1.sql" {
+    t.Errorf("unexpected revisions %v", revisionPaths(revisions))
+  }
+}
+
+func TestMemFSRemove(t *testing.T) {
+  fs := NewMemFS()
+  fs.WriteFile("/db/V1.sql", nil, 0644)
+  if err := fs.Remove("/db"); err == nil {
+    t.Errorf("expected removing a directory with files in it to error")
+  }
+  if err := fs.Remove("/db/V1.sql"); err != nil {
+    t.Fatal(err)
+  }
+  if err := fs.Remove("/db"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := fs.Stat("/db"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected /db to be removed got %v", err)
+  }
+  if err := fs.Remove("/db"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected removing a missing file to error got %v", err)
+  }
+}
+
+// open files keep the data they were opened with
+func TestMemFSOpenSnapshot(t *testing.T) {
+  fs := NewMemFS()
+  fs.WriteFile("/1.sql", []byte("SELECT 1;"), 0644)
+  f, err := fs.Open("/1.sql")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  fs.WriteFile("/1.sql", []byte("SELECT 2;"), 0644)
+
+  out := make([]byte, 6)
+  if _, err := f.ReadAt(out, 3); err != nil || string(out) != "ECT 1;" {
+    t.Errorf("expected %q got %q %v", "ECT 1;", out, err)
+  }
+  if _, err := f.Seek(7, 0); err != nil {
+    t.Fatal(err)
+  }
+  rest, _ := ioutil.ReadAll(f)
+  if string(rest) != "1;" {
+    t.Errorf("expected %q got %q", "1;", rest)
+  }
+  dir, _ := fs.Open("/")
+  if _, err := dir.Read(out); err == nil {
+    t.Errorf("expected reading a directory to error")
+  }
+}
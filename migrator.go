@@ -0,0 +1,604 @@
+package drift
+
+import (
+  "io"
+  "fmt"
+  "errors"
+  "time"
+  "context"
+  "strings"
+  "unicode"
+  "database/sql"
+)
+
+// the outcome of applying a changeset
+type Status int
+
+const (
+  Executed Status = iota
+  Failed
+  Skipped
+  Reexecuted   // an applied changeset run again because of runalways or runonchange
+  RolledBack
+  MarkedRan    // recorded as applied without running because a precondition failed
+  Partial      // failed after some of its statements ran outside of a transaction
+)
+
+func (s Status) String() string {
+  switch s {
+  case Executed:
+    return "EXECUTED"
+  case Failed:
+    return "FAILED"
+  case Skipped:
+    return "SKIPPED"
+  case Reexecuted:
+    return "RERAN"
+  case RolledBack:
+    return "ROLLED BACK"
+  case MarkedRan:
+    return "MARK_RAN"
+  case Partial:
+    return "PARTIAL"
+  }
+  return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// a Partial changeset that hasn't been edited since it failed
+var errPartial = errors.New("some of its statements ran before it failed, fix the database and edit the changeset to run it again")
+
+// test if a changeset with this status has been applied to the database
+func (s Status) applied() bool {
+  return s == Executed || s == Reexecuted || s == MarkedRan
+}
+
+// A Result records what happened to a single changeset during a migration
+type Result struct {
+  Path     string          // path of the revision the changeset is in
+  ID       string          // id of the changeset
+  Status   Status
+  Err      error           // set when the changeset failed
+  Warning  string          // set when a precondition failed but didn't stop the changeset
+  Duration time.Duration   // how long the changeset took to run
+}
+
+func (r *Result) String() string {
+  s := fmt.Sprintf("%s %s::%s", r.Status, r.Path, r.ID)
+  if r.Status != Skipped && r.Status != MarkedRan {
+    s = fmt.Sprintf("%s (%s)", s, r.Duration)
+  }
+  if len(r.Warning) > 0 {
+    s = fmt.Sprintf("%s: warning: %s", s, r.Warning)
+  }
+  if r.Err != nil {
+    s = fmt.Sprintf("%s: %v", s, r.Err)
+  }
+  return s
+}
+
+// A Summary is the result of every changeset in a migration, in order
+type Summary []*Result
+
+// the number of changesets with the given status
+func (s Summary) Count(status Status) int {
+  count := 0
+  for _, r := range(s) {
+    if r.Status == status {
+      count++
+    }
+  }
+  return count
+}
+
+// one result per line
+func (s Summary) String() string {
+  var lines []string
+  for _, r := range(s) {
+    lines = append(lines, r.String())
+  }
+  return strings.Join(lines, "\n")
+}
+
+// An ExecError is a changeset that failed to run against the database
+type ExecError struct {
+  Path string
+  ID   string
+  Err  error
+}
+
+func (e *ExecError) Error() string {
+  return fmt.Sprintf("%s: changeset %s: %v", e.Path, e.ID, e.Err)
+}
+
+func (e *ExecError) Unwrap() error { return e.Err }
+
+// A Migrator applies the changesets in a set of revisions to a database
+// applied changesets are recorded in a history table so they only run once
+type Migrator struct {
+  db        *sql.DB
+  dbms      string
+  dialect   *Dialect
+  table     string
+  revisions []*Revision
+  contexts  []string            // the contexts changesets run in, any if empty
+  defaults  map[string]string   // attributes every changeset header has
+}
+
+// creates a Migrator for the revisions, in the order they should be applied
+// dbms names the database so changesets with a dbms attribute that doesn't
+// include it are skipped, it also picks the Dialect used for the history table
+// e.g. NewMigrator(db, "ql", revisions...)
+func NewMigrator(db *sql.DB, dbms string, revisions ...*Revision) *Migrator {
+  return &Migrator{
+    db:        db,
+    dbms:      dbms,
+    dialect:   LookupDialect(dbms),
+    revisions: revisions,
+  }
+}
+
+// overrides the dialect picked from the dbms name
+func (m *Migrator) SetDialect(d *Dialect) {
+  m.dialect = d
+}
+
+// overrides the dialect's history table name
+func (m *Migrator) SetHistoryTable(table string) {
+  m.table = table
+}
+
+// only runs changesets in one of the contexts
+// a changeset's contexts are given by its context attribute, a comma
+// separated list, changesets without one run in every context
+// without any contexts every changeset runs, whatever its context attribute
+// e.g. SetContexts("dev", "test")
+func (m *Migrator) SetContexts(contexts ...string) {
+  m.contexts = contexts
+}
+
+// gives every changeset header the attributes it doesn't give itself
+// e.g. SetDefaultAttributes(map[string]string{"author": "ops", "failonerror": "false"})
+func (m *Migrator) SetDefaultAttributes(defaults map[string]string) error {
+  if err := checkDefaultAttributes(defaults); err != nil {
+    return err
+  }
+  m.defaults = defaults
+  return nil
+}
+
+// the history table, created if it doesn't exist yet and create is set
+// only Migrate and Rollback create it, so reading the history doesn't need
+// permission to change the database
+func (m *Migrator) history(create bool) (*history, error) {
+  table := m.table
+  if len(table) == 0 {
+    table = m.dialect.HistoryTable
+  }
+  if len(table) == 0 {
+    table = DefaultHistoryTable
+  }
+  h := &history{m.db, m.dialect, table}
+  if !create {
+    return h, nil
+  }
+  if err := h.create(); err != nil {
+    return nil, err
+  }
+  return h, nil
+}
+
+// the changesets recorded in the history table in the order they were run
+// there's no history before the first migration creates the table, dialects
+// without a TableExists query can't tell so the table has to be there
+func (m *Migrator) History() ([]*HistoryEntry, error) {
+  h, err := m.history(false)
+  if err != nil {
+    return nil, err
+  }
+  if len(m.dialect.TableExists) > 0 {
+    exists, err := m.exists(m.dialect.TableExists, h.table)
+    if err != nil || !exists {
+      return nil, err
+    }
+  }
+  return h.entries()
+}
+
+// A PendingChangeset is a changeset that will be run by the next Migrate
+type PendingChangeset struct {
+  Revision  *Revision
+  Changeset *Changeset
+}
+
+// calls fn with every changeset of every revision in order
+// revisions are parsed a changeset at a time so only the changeset fn is
+// looking at is held in memory
+func (m *Migrator) each(fn func(PendingChangeset) error) error {
+  for _, rev := range(m.revisions) {
+    if err := eachChangeset(rev, m.dialect, m.defaults, fn); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// calls fn with every changeset of a revision in order
+// a revision with errors is parsed to the end so they're all returned together
+// as ParseErrors, fn isn't called again after the first one
+func eachChangeset(rev *Revision, d *Dialect, defaults map[string]string, fn func(PendingChangeset) error) error {
+  r, err := rev.Changesets()
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+  r.SetNestedComments(d.NestedComments)
+  r.SetBackslashEscapes(d.BackslashEscapes)
+  r.SetDefaultAttributes(defaults)
+
+  var errs ParseErrors
+  for {
+    cs, err := r.Next()
+    if err == io.EOF {
+      break
+    }
+    if perrs, ok := err.(ParseErrors); ok {
+      errs = append(errs, perrs...)
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    if len(errs) == 0 {
+      if err := fn(PendingChangeset{rev, cs}); err != nil {
+        return err
+      }
+    }
+  }
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+// every changeset of every revision in order
+func (m *Migrator) changesets() ([]PendingChangeset, error) {
+  var all []PendingChangeset
+  err := m.each(func(p PendingChangeset) error {
+    all = append(all, p)
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return all, nil
+}
+
+// test if a changeset should be run against the migrator's dbms in its
+// contexts
+func (m *Migrator) targets(cs *Changeset) bool {
+  if len(m.dbms) > 0 && !matches(cs.DBMS(), []string{m.dbms}) {
+    return false
+  }
+  return matches(cs.Contexts(), m.contexts)
+}
+
+// test if any of the wanted names are allowed, empty lists allow anything
+func matches(allowed []string, wanted []string) bool {
+  if len(allowed) == 0 || len(wanted) == 0 {
+    return true
+  }
+  for _, a := range(allowed) {
+    for _, w := range(wanted) {
+      if strings.EqualFold(a, w) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// the latest history entry of every changeset keyed by historyKey
+func applied(entries []*HistoryEntry) map[string]*HistoryEntry {
+  latest := make(map[string]*HistoryEntry)
+  for _, e := range(entries) {
+    latest[historyKey(e.Path, e.ID)] = e
+  }
+  return latest
+}
+
+// test if a changeset needs to run given its history entry
+// runalways changesets run every time, runonchange changesets run again once
+// they have been edited
+func (m *Migrator) pending(entry *HistoryEntry, cs *Changeset) bool {
+  return entry == nil || !entry.Status.applied() || cs.RunAlways() || cs.RunOnChange() && edited(entry, cs)
+}
+
+// parses every revision and finds applied changesets that have been edited
+// and aren't runonchange, runalways changesets are run every time so editing
+// them is fine
+// everything is parsed up front so a bad revision doesn't leave the database
+// half migrated
+func (m *Migrator) validate(latest map[string]*HistoryEntry) error {
+  var errs ChecksumErrors
+  err := m.each(func(p PendingChangeset) error {
+    entry := latest[historyKey(p.Revision.path, p.Changeset.ID())]
+    cs := p.Changeset
+    if m.targets(cs) && !cs.RunOnChange() && !cs.RunAlways() && edited(entry, cs) {
+      errs = append(errs, &ChecksumError{
+        Path:     p.Revision.path,
+        ID:       p.Changeset.ID(),
+        Expected: entry.Checksum,
+        Actual:   p.Changeset.Checksum(),
+      })
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+// checks that every revision parses and that no applied changeset has been
+// edited since it ran, edits are returned as ChecksumErrors
+func (m *Migrator) Validate() error {
+  entries, err := m.History()
+  if err != nil {
+    return err
+  }
+  return m.validate(applied(entries))
+}
+
+// the changesets the next Migrate will run, in order
+func (m *Migrator) Pending() ([]PendingChangeset, error) {
+  entries, err := m.History()
+  if err != nil {
+    return nil, err
+  }
+  latest := applied(entries)
+  if err := m.validate(latest); err != nil {
+    return nil, err
+  }
+
+  var pending []PendingChangeset
+  err = m.each(func(p PendingChangeset) error {
+    if m.targets(p.Changeset) && m.pending(latest[historyKey(p.Revision.path, p.Changeset.ID())], p.Changeset) {
+      pending = append(pending, p)
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return pending, nil
+}
+
+// applies each pending changeset in order and records it in the history table
+// changesets that have already been applied are only run again when they are
+// runalways or edited runonchange, these are reported as Reexecuted and their
+// history entry is updated rather than added again
+// nothing is run if a revision doesn't parse or an applied changeset has been
+// edited, see Validate
+// the revisions are read through twice, once to validate them and once to
+// apply them, a changeset at a time so streamed revisions from OpenRevision
+// never have to be held in memory
+// preconditions are checked right before a changeset runs, what happens when
+// they fail is up to the changeset's onfail, see OnFail
+// a failing changeset stops the migration unless it is marked failonerror:false
+// in which case the failure is recorded and the migration carries on, failed
+// changesets are tried again on the next migration
+// the summary holds every changeset looked at so far
+func (m *Migrator) Migrate() (Summary, error) {
+  var summary Summary
+  h, err := m.history(true)
+  if err != nil {
+    return nil, err
+  }
+  entries, err := h.entries()
+  if err != nil {
+    return nil, err
+  }
+  latest := applied(entries)
+  if err := m.validate(latest); err != nil {
+    return nil, err
+  }
+  var order int64
+  for _, e := range(entries) {
+    if e.Order > order {
+      order = e.Order
+    }
+  }
+
+  err = m.each(func(p PendingChangeset) error {
+    key := historyKey(p.Revision.path, p.Changeset.ID())
+    if !m.targets(p.Changeset) {
+      summary = append(summary, &Result{Path: p.Revision.path, ID: p.Changeset.ID(), Status: Skipped})
+      return nil
+    }
+    if !m.pending(latest[key], p.Changeset) {
+      return nil
+    }
+    // running a partly applied changeset again would run its first statements
+    // twice, it's only retried once it has been edited
+    if e := latest[key]; e != nil && e.Status == Partial && e.Checksum == p.Changeset.Checksum() {
+      err := &ExecError{p.Revision.path, p.Changeset.ID(), errPartial}
+      summary = append(summary, &Result{Path: p.Revision.path, ID: p.Changeset.ID(), Status: Failed, Err: err})
+      return err
+    }
+
+    failed, err := m.check(p.Changeset)
+    if err != nil {
+      return &ExecError{p.Revision.path, p.Changeset.ID(), err}
+    }
+    var warning string
+    if failed != nil {
+      perr := &PreconditionError{p.Revision.path, p.Changeset.ID(), *failed}
+      switch p.Changeset.OnFail() {
+      case OnFailHalt:
+        summary = append(summary, &Result{Path: p.Revision.path, ID: p.Changeset.ID(), Status: Failed, Err: perr})
+        return perr
+      case OnFailContinue:
+        summary = append(summary, &Result{Path: p.Revision.path, ID: p.Changeset.ID(), Status: Skipped, Warning: perr.Error()})
+        return nil
+      case OnFailWarn:
+        warning = perr.Error()
+      }
+    }
+
+    // changesets that run again keep their place in the history, so rolling
+    // back by count follows the order changesets were first applied in
+    var position int64
+    if previous := latest[key]; previous != nil && previous.Status.applied() {
+      position = previous.Order
+    } else {
+      order++
+      position = order
+    }
+    var result *Result
+    var entry *HistoryEntry
+    if failed != nil && p.Changeset.OnFail() == OnFailMarkRan {
+      result, entry = m.markRan(p, position)
+      result.Warning = (&PreconditionError{p.Revision.path, p.Changeset.ID(), *failed}).Error()
+      err = h.save(nil, entry, latest[key] != nil)
+    } else {
+      result, entry, err = m.apply(h, p, position, latest[key])
+      result.Warning = warning
+    }
+    summary = append(summary, result)
+    if err != nil {
+      return err
+    }
+    latest[key] = entry
+
+    if result.Status == Failed && p.Changeset.FailOnError() {
+      return &ExecError{p.Revision.path, p.Changeset.ID(), result.Err}
+    }
+    return nil
+  })
+  return summary, err
+}
+
+// runs a changeset and records it in the history returning its result and
+// history entry
+// previous is the changeset's existing history entry if it has one
+// statements that ran outside of a transaction before one failed can't be
+// taken back, so the changeset is recorded as Partial rather than Failed
+func (m *Migrator) apply(h *history, p PendingChangeset, order int64, previous *HistoryEntry) (*Result, *HistoryEntry, error) {
+  result := &Result{
+    Path:     p.Revision.path,
+    ID:       p.Changeset.ID(),
+    Status:   Executed,
+  }
+  entry := &HistoryEntry{
+    Path:     p.Revision.path,
+    ID:       p.Changeset.ID(),
+    Author:   p.Changeset.Author(),
+    Checksum: p.Changeset.Checksum(),
+    Executed: time.Now(),
+    Order:    order,
+  }
+  err := m.run(p.Changeset.Statements(), func(tx *sql.Tx, ran int, err error) error {
+    result.Duration = time.Since(entry.Executed)
+    entry.Duration = result.Duration
+    if err != nil {
+      result.Status = Failed
+      result.Err = err
+    } else if previous != nil && previous.Status.applied() {
+      result.Status = Reexecuted
+    }
+    entry.Status = result.Status
+    if err != nil && ran > 0 {
+      entry.Status = Partial
+    }
+    return h.save(tx, entry, previous != nil)
+  })
+  return result, entry, err
+}
+
+// runs statements one at a time stopping at the first that fails, which is
+// passed to record as a StatementError with the number of statements that
+// ran and stayed run before it
+// they all run on the same connection so a BEGIN in one statement covers the
+// statements after it
+// record writes the history, when the dialect has transactional ddl it's
+// given the transaction the statements ran in, which is only committed if
+// both succeed, so a failing changeset leaves nothing behind and a failing
+// history write doesn't leave the changeset applied but unrecorded
+// changesets that start or end transactions themselves can't be wrapped in
+// one, they run like they would without transactional ddl
+func (m *Migrator) run(statements []string, record func(tx *sql.Tx, ran int, err error) error) error {
+  ctx := context.Background()
+  conn, err := m.db.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  if !m.dialect.TransactionalDDL || ownsTransaction(statements) {
+    ran, err := execStatements(ctx, conn, statements)
+    return record(nil, ran, err)
+  }
+  tx, err := conn.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+  if _, err := execStatements(ctx, tx, statements); err != nil {
+    tx.Rollback()
+    return record(nil, 0, err)
+  }
+  if err := record(tx, len(statements), nil); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+// something statements can run on, a connection or a transaction
+type execer interface {
+  ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// runs statements in order returning how many ran before one failed
+func execStatements(ctx context.Context, x execer, statements []string) (int, error) {
+  for i, statement := range(statements) {
+    if _, err := x.ExecContext(ctx, statement); err != nil {
+      return i, &StatementError{Index: i + 1, Statement: statement, Err: err}
+    }
+  }
+  return len(statements), nil
+}
+
+// test if statements start, end or roll back a transaction themselves
+func ownsTransaction(statements []string) bool {
+  for _, statement := range(statements) {
+    tok, err := NewScanner([]byte(statement)).NextToken()
+    if err != nil || tok.ttype != IDENT {
+      continue
+    }
+    word := strings.TrimRightFunc(string(tok.runes), func(r rune) bool { return !unicode.IsLetter(r) })
+    switch strings.ToUpper(word) {
+    case "BEGIN", "START", "COMMIT", "ROLLBACK", "END":
+      return true
+    }
+  }
+  return false
+}
+
+// records a changeset as applied without running it
+func (m *Migrator) markRan(p PendingChangeset, order int64) (*Result, *HistoryEntry) {
+  return &Result{
+    Path:   p.Revision.path,
+    ID:     p.Changeset.ID(),
+    Status: MarkedRan,
+  }, &HistoryEntry{
+    Path:     p.Revision.path,
+    ID:       p.Changeset.ID(),
+    Author:   p.Changeset.Author(),
+    Checksum: p.Changeset.Checksum(),
+    Executed: time.Now(),
+    Status:   MarkedRan,
+    Order:    order,
+  }
+}
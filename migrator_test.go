@@ -0,0 +1,588 @@
+package drift
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestMigrate(t *testing.T) {
+  db, fake := newFakeDB(t)
+  first := &Revision{data: []byte(`
+--+ changeset id:1 author:jgilbert
+CREATE TABLE a (id int);
+--+ changeset id:2 dbms:postgres
+CREATE TABLE b (id int);
+--+ changeset id:3 dbms:postgres, ql
+CREATE TABLE c (id int);`), path: "/tmp/1.sql"}
+  second := &Revision{data: []byte(`
+--+ changeset id:1
+INSERT INTO a VALUES (1);`), path: "/tmp/2.sql"}
+
+  summary, err := NewMigrator(db, "ql", first, second).Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  expected := []string{
+    "CREATE TABLE a (id int);",
+    "CREATE TABLE c (id int);",
+    "INSERT INTO a VALUES (1);",
+  }
+  if strings.Join(fake.statements(), "|") != strings.Join(expected, "|") {
+    t.Errorf("expected %v got %v", expected, fake.statements())
+  }
+  for index, value := range([]struct{
+    path   string
+    id     string
+    status Status
+  }{
+    {"/tmp/1.sql", "1", Executed},
+    {"/tmp/1.sql", "2", Skipped},
+    {"/tmp/1.sql", "3", Executed},
+    {"/tmp/2.sql", "1", Executed},
+  }) {
+    r := summary[index]
+    if r.Path != value.path || r.ID != value.id || r.Status != value.status {
+      t.Errorf("expected %v::%v %v got %v", value.path, value.id, value.status, r)
+    }
+  }
+  if summary.Count(Executed) != 3 || summary.Count(Skipped) != 1 {
+    t.Errorf("unexpected summary %v", summary)
+  }
+}
+
+// streamed revisions are read once to validate them and once to apply them
+func TestMigrateStreamed(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fs := NewMemFS()
+  fs.WriteFile("/tmp/1.sql", []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:2
+INSERT INTO a VALUES (1);`), 0644)
+  rev, err := OpenRevision("/tmp/1.sql", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  summary, err := NewMigrator(db, "ql", rev).Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  expected := "CREATE TABLE a (id int);|INSERT INTO a VALUES (1);"
+  if strings.Join(fake.statements(), "|") != expected {
+    t.Errorf("expected %v got %v", expected, fake.statements())
+  }
+  if summary.Count(Executed) != 2 {
+    t.Errorf("unexpected summary %v", summary)
+  }
+}
+
+// whether block comments nest is up to the dialect
+func TestMigrateNestedComments(t *testing.T) {
+  db, _ := newFakeDB(t)
+  rev := &Revision{data: []byte(`--+ changeset id:1
+/* a /* b */
+SELECT 1;`), path: "/tmp/1.sql"}
+  if err := NewMigrator(db, "ql", rev).Validate(); err != nil {
+    t.Errorf("unexpected error %v", err)
+  }
+  expected := "/tmp/1.sql:2:1: unterminated comment"
+  if err := NewMigrator(db, "postgres", rev).Validate(); err == nil || err.Error() != expected {
+    t.Errorf("expected '%v' got '%v'", expected, err)
+  }
+}
+
+// so are backslash escapes, a mysql string can end in an escaped quote
+func TestMigrateBackslashEscapes(t *testing.T) {
+  db, fake := newFakeDB(t)
+  rev := &Revision{data: []byte(`--+ changeset id:1
+INSERT INTO t VALUES ('it\'s;'); INSERT INTO t VALUES ('\\');`), path: "/tmp/1.sql"}
+  expected := "/tmp/1.sql:2:59: unterminated string"
+  if err := NewMigrator(db, "ql", rev).Validate(); err == nil || err.Error() != expected {
+    t.Errorf("expected '%v' got '%v'", expected, err)
+  }
+  if _, err := NewMigrator(db, "mysql", rev).Migrate(); err != nil {
+    t.Fatal(err)
+  }
+  statements := []string{`INSERT INTO t VALUES ('it\'s;');`, `INSERT INTO t VALUES ('\\');`}
+  if strings.Join(fake.statements(), "|") != strings.Join(statements, "|") {
+    t.Errorf("expected %v got %v", statements, fake.statements())
+  }
+}
+
+// a changeset with the id of one before it is an error rather than never
+// running and then failing the checksum of the first
+func TestMigrateDuplicateID(t *testing.T) {
+  db, fake := newFakeDB(t)
+  rev := &Revision{data: []byte(`--+ changeset id:a
+CREATE TABLE a (id int);
+--+ changeset id:a
+CREATE TABLE b (id int);`), path: "/tmp/1.sql"}
+  m := NewMigrator(db, "ql", rev)
+  expected := "/tmp/1.sql:3:1: duplicate changeset id 'a'"
+  for run := 0; run < 2; run++ {
+    if _, err := m.Migrate(); err == nil || err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err)
+    }
+  }
+  if len(fake.statements()) != 0 {
+    t.Errorf("expected nothing to run got %v", fake.statements())
+  }
+}
+
+func TestMigrateFailOnError(t *testing.T) {
+  db, fake := newFakeDB(t)
+  boom := errors.New("boom")
+  fake.fail["BAD"] = boom
+  rev := &Revision{data: []byte(`
+--+ changeset id:1 failonerror:false
+BAD STATEMENT;
+--+ changeset id:2
+BAD STATEMENT AGAIN;
+--+ changeset id:3
+SELECT 1;`), path: "/tmp/1.sql"}
+
+  summary, err := NewMigrator(db, "ql", rev).Migrate()
+  execErr, ok := err.(*ExecError)
+  if !ok {
+    t.Fatalf("expected an ExecError got %v", err)
+  }
+  if execErr.Path != "/tmp/1.sql" || execErr.ID != "2" || !errors.Is(err, boom) {
+    t.Errorf("unexpected error %v", err)
+  }
+  // changeset 3 is never reached
+  if len(summary) != 2 {
+    t.Fatalf("expected %v results got %v", 2, len(summary))
+  }
+  if summary[0].Status != Failed || !errors.Is(summary[0].Err, boom) {
+    t.Errorf("expected changeset 1 to fail got %v", summary[0])
+  }
+  if serr, ok := summary[0].Err.(*StatementError); !ok || serr.Index != 1 || serr.Statement != "BAD STATEMENT;" {
+    t.Errorf("expected statement 1 to fail got %v", summary[0].Err)
+  }
+  if summary[1].Status != Failed {
+    t.Errorf("expected changeset 2 to fail got %v", summary[1])
+  }
+  if len(fake.statements()) != 0 {
+    t.Errorf("expected nothing to run got %v", fake.statements())
+  }
+}
+
+// statements run one at a time on the same connection and the one that fails
+// is reported
+func TestMigrateStatements(t *testing.T) {
+  db, fake := newFakeDB(t)
+  boom := errors.New("boom")
+  fake.fail["BAD"] = boom
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+BEGIN TRANSACTION;
+-- the rows
+INSERT INTO a VALUES ('x;y');INSERT INTO a VALUES (2);
+COMMIT;
+--+ changeset id:2
+SELECT 1; SELECT BAD;
+SELECT 3;`), path: "/tmp/1.sql"}
+
+  _, err := NewMigrator(db, "ql", rev).Migrate()
+  // changeset 1 runs its own transaction, changeset 2 runs in one that's
+  // rolled back when it fails
+  expected := []string{
+    "BEGIN TRANSACTION;",
+    "-- the rows\nINSERT INTO a VALUES ('x;y');",
+    "INSERT INTO a VALUES (2);",
+    "COMMIT;",
+  }
+  if strings.Join(fake.statements(), "|") != strings.Join(expected, "|") {
+    t.Errorf("expected %v got %v", expected, fake.statements())
+  }
+  expectedErr := "/tmp/1.sql: changeset 2: statement 2 (SELECT BAD;): boom"
+  if err == nil || err.Error() != expectedErr {
+    t.Errorf("expected '%v' got '%v'", expectedErr, err)
+  }
+}
+
+// a changeset that fails part way through is retried from the start when the
+// dialect can roll back ddl, otherwise it isn't retried until it's edited
+func TestMigratePartialFailure(t *testing.T) {
+  for _, dbms := range([]string{"ql", "mysql"}) {
+    db, fake := newFakeDB(t)
+    boom := errors.New("boom")
+    fake.fail["boom"] = boom
+    rev := &Revision{data: []byte(`--+ changeset id:1
+CREATE TABLE a (id int); INSERT boom;`), path: "/tmp/1.sql"}
+    m := NewMigrator(db, dbms, rev)
+    if _, err := m.Migrate(); !errors.Is(err, boom) {
+      t.Errorf("%v: expected the changeset to fail got %v", dbms, err)
+    }
+    entries, _ := m.History()
+    delete(fake.fail, "boom")
+    summary, err := m.Migrate()
+    statements := strings.Join(fake.statements(), "|")
+
+    if dbms == "ql" {
+      if len(entries) != 1 || entries[0].Status != Failed {
+        t.Errorf("%v: unexpected entries %+v", dbms, entries)
+      }
+      if err != nil || summary.Count(Executed) != 1 || statements != "CREATE TABLE a (id int);|INSERT boom;" {
+        t.Errorf("%v: expected the changeset to run once got %v %v %v", dbms, summary, err, statements)
+      }
+      continue
+    }
+    if len(entries) != 1 || entries[0].Status != Partial {
+      t.Errorf("%v: unexpected entries %+v", dbms, entries)
+    }
+    expected := "/tmp/1.sql: changeset 1: " + errPartial.Error()
+    if err == nil || err.Error() != expected || statements != "CREATE TABLE a (id int);" {
+      t.Errorf("%v: expected '%v' got '%v' %v", dbms, expected, err, statements)
+    }
+    // taking out the statements that ran lets it run again
+    rev.data = []byte("--+ changeset id:1\nINSERT boom;")
+    if summary, err := m.Migrate(); err != nil || summary.Count(Executed) != 1 {
+      t.Errorf("%v: expected the edited changeset to run got %v %v", dbms, summary, err)
+    }
+    if statements := strings.Join(fake.statements(), "|"); statements != "CREATE TABLE a (id int);|INSERT boom;" {
+      t.Errorf("%v: unexpected statements %v", dbms, statements)
+    }
+  }
+}
+
+// nothing is run when a revision doesn't parse
+func TestMigrateParseError(t *testing.T) {
+  db, fake := newFakeDB(t)
+  good := &Revision{data: []byte("--+ changeset id:1\nSELECT 1;"), path: "/tmp/1.sql"}
+  bad := &Revision{data: []byte("SELECT 2;"), path: "/tmp/2.sql"}
+  _, err := NewMigrator(db, "ql", good, bad).Migrate()
+  if _, ok := err.(ParseErrors); !ok {
+    t.Errorf("expected ParseErrors got %v", err)
+  }
+  if len(fake.statements()) != 0 {
+    t.Errorf("expected nothing to run got %v", fake.statements())
+  }
+}
+
+func TestMigrateHistory(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fake.fail["BAD"] = errors.New("boom")
+  rev := &Revision{data: []byte(`
+--+ changeset id:1 author:jgilbert
+CREATE TABLE a (id int);
+--+ changeset id:2 failonerror:false
+BAD STATEMENT;
+--+ changeset id:3
+CREATE TABLE c (id int);`), path: "/tmp/1.sql"}
+
+  m := NewMigrator(db, "ql", rev)
+  if _, err := m.Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  entries, err := m.History()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  for index, value := range([]struct{
+    id     string
+    author string
+    status Status
+    order  int64
+  }{
+    {"1", "jgilbert", Executed, 1},
+    {"2", "", Failed, 2},
+    {"3", "", Executed, 3},
+  }) {
+    e := entries[index]
+    if e.Path != "/tmp/1.sql" || e.ID != value.id || e.Author != value.author {
+      t.Errorf("expected %v by '%v' got %v by '%v'", value.id, value.author, e.ID, e.Author)
+    }
+    if e.Status != value.status || e.Order != value.order {
+      t.Errorf("expected %v %v got %v %v", value.status, value.order, e.Status, e.Order)
+    }
+    if e.Executed.IsZero() {
+      t.Errorf("expected the execution time to be recorded")
+    }
+  }
+
+  // only the failed changeset is still pending
+  pending, err := m.Pending()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(pending) != 1 || pending[0].Changeset.ID() != "2" {
+    t.Errorf("expected changeset 2 to be pending got %v", pending)
+  }
+
+  // the failed changeset is retried and its entry updated
+  delete(fake.fail, "BAD")
+  summary, err := m.Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(summary) != 1 || summary[0].ID != "2" || summary[0].Status != Executed {
+    t.Errorf("expected only changeset 2 to run got %v", summary)
+  }
+  entries, _ = m.History()
+  if len(entries) != 3 {
+    t.Fatalf("expected %v entries got %v", 3, len(entries))
+  }
+  if entries[2].ID != "2" || entries[2].Status != Executed || entries[2].Order != 4 {
+    t.Errorf("expected changeset 2 to be executed last got %+v", entries[2])
+  }
+
+  // nothing left to do
+  summary, err = m.Migrate()
+  if err != nil || len(summary) != 0 {
+    t.Errorf("expected nothing to run got %v %v", summary, err)
+  }
+  if len(fake.statements()) != 3 {
+    t.Errorf("expected %v statements got %v", 3, fake.statements())
+  }
+}
+
+// reading the history doesn't create the table, so it works without
+// permission to change the database
+func TestMigrateReadOnly(t *testing.T) {
+  db, fake := newFakeDB(t)
+  m := NewMigrator(db, "ql", &Revision{data: []byte("--+ changeset id:1\nSELECT 1;"), path: "/tmp/1.sql"})
+  entries, err := m.History()
+  if err != nil || len(entries) != 0 {
+    t.Errorf("expected no history got %v %v", entries, err)
+  }
+  pending, err := m.Pending()
+  if err != nil || len(pending) != 1 {
+    t.Errorf("expected 1 pending changeset got %v %v", pending, err)
+  }
+  if err := m.Validate(); err != nil {
+    t.Errorf("unexpected error %v", err)
+  }
+  if fake.created {
+    t.Errorf("expected the history table not to be created")
+  }
+  if _, err := m.Migrate(); err != nil || !fake.created {
+    t.Errorf("expected the migration to create the table got %v", err)
+  }
+
+  // without a TableExists query the table has to be there
+  d := *LookupDialect("ql")
+  d.TableExists = ""
+  m.SetDialect(&d)
+  fake.created = false
+  if _, err := m.History(); err == nil {
+    t.Errorf("expected a missing table to error")
+  }
+}
+
+func TestMigrateHistoryTable(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fake.table = "my_history"
+  rev := &Revision{data: []byte("--+ changeset id:1\nSELECT 1;"), path: "/tmp/1.sql"}
+  m := NewMigrator(db, "postgres", rev)
+  m.SetHistoryTable("my_history")
+  if _, err := m.Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(fake.history) != 1 {
+    t.Errorf("expected %v entries in my_history got %v", 1, len(fake.history))
+  }
+}
+
+func TestMigrateEdited(t *testing.T) {
+  db, fake := newFakeDB(t)
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:2 runonchange:true
+CREATE VIEW v AS SELECT id FROM a;`), path: "/tmp/1.sql"}
+  if _, err := NewMigrator(db, "ql", rev).Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+
+  // reformatting isn't an edit
+  rev.data = []byte(`
+--+ changeset id:1
+-- the a table
+CREATE TABLE a
+  (id int);
+--+ changeset id:2 runonchange:true
+CREATE VIEW v AS SELECT id FROM a;
+--+ changeset id:3
+CREATE TABLE b (id int);`)
+  m := NewMigrator(db, "ql", rev)
+  if err := m.Validate(); err != nil {
+    t.Errorf("unexpected error %v", err)
+  }
+
+  // runonchange changesets run again once edited
+  rev.data = []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:2 runonchange:true
+CREATE VIEW v AS SELECT id, 1 AS one FROM a;`)
+  summary, err := m.Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(summary) != 1 || summary[0].ID != "2" || summary[0].Status != Reexecuted {
+    t.Errorf("expected changeset 2 to run again got %v", summary)
+  }
+  entries, _ := m.History()
+  if len(entries) != 2 || entries[1].Checksum != checksum("CREATE VIEW v AS SELECT id, 1 AS one FROM a;", false, false) {
+    t.Errorf("expected the new checksum to be recorded got %+v", entries)
+  }
+
+  // anything else fails loudly and nothing runs
+  executed := len(fake.statements())
+  rev.data = []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int, name string);
+--+ changeset id:2 runonchange:true
+CREATE VIEW v AS SELECT id, 2 AS two FROM a;`)
+  _, err = m.Migrate()
+  errs, ok := err.(ChecksumErrors)
+  if !ok {
+    t.Fatalf("expected ChecksumErrors got %v", err)
+  }
+  if len(errs) != 1 || errs[0].Path != "/tmp/1.sql" || errs[0].ID != "1" {
+    t.Errorf("expected changeset 1 to be edited got %v", errs)
+  }
+  if errs[0].Expected != checksum("CREATE TABLE a (id int);", false, false) {
+    t.Errorf("expected the recorded checksum got %v", errs[0].Expected)
+  }
+  if len(fake.statements()) != executed {
+    t.Errorf("expected nothing to run got %v", fake.statements()[executed:])
+  }
+  if _, err := m.Pending(); err == nil {
+    t.Errorf("expected pending to fail on edited changesets")
+  }
+  if err := m.Validate(); err == nil {
+    t.Errorf("expected validate to fail on edited changesets")
+  }
+}
+
+func TestMigrateRunAlways(t *testing.T) {
+  db, fake := newFakeDB(t)
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:grants runalways:true
+GRANT SELECT ON a TO reporting;`), path: "/tmp/1.sql"}
+
+  m := NewMigrator(db, "ql", rev)
+  summary, err := m.Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if summary.Count(Executed) != 2 {
+    t.Errorf("expected both changesets to run got %v", summary)
+  }
+
+  for run := 0; run < 2; run++ {
+    pending, err := m.Pending()
+    if err != nil {
+      t.Fatalf("unexpected error %v", err)
+    }
+    if len(pending) != 1 || pending[0].Changeset.ID() != "grants" {
+      t.Errorf("expected grants to be pending got %v", pending)
+    }
+    summary, err := m.Migrate()
+    if err != nil {
+      t.Fatalf("unexpected error %v", err)
+    }
+    if len(summary) != 1 || summary[0].ID != "grants" || summary[0].Status != Reexecuted {
+      t.Errorf("expected grants to run again got %v", summary)
+    }
+    if !strings.HasPrefix(summary.String(), "RERAN /tmp/1.sql::grants (") {
+      t.Errorf("unexpected summary '%v'", summary)
+    }
+  }
+
+  // the entry is updated rather than duplicated
+  entries, _ := m.History()
+  if len(entries) != 2 {
+    t.Fatalf("expected %v entries got %v", 2, len(entries))
+  }
+  if entries[1].ID != "grants" || entries[1].Status != Reexecuted || entries[1].Order != 2 {
+    t.Errorf("unexpected entry %+v", entries[1])
+  }
+  if len(fake.statements()) != 4 {
+    t.Errorf("expected %v statements got %v", 4, fake.statements())
+  }
+
+  // editing a runalways changeset is fine
+  rev.data = []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:grants runalways:true
+GRANT SELECT, INSERT ON a TO reporting;`)
+  if err := m.Validate(); err != nil {
+    t.Errorf("unexpected error %v", err)
+  }
+}
+
+func TestMigrateContexts(t *testing.T) {
+  db, fake := newFakeDB(t)
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+CREATE TABLE a (id int);
+--+ changeset id:seed context:dev, test
+INSERT INTO a VALUES (1);
+--+ changeset id:grants context:prod
+GRANT SELECT ON a TO reporting;`), path: "/tmp/1.sql"}
+
+  m := NewMigrator(db, "ql", rev)
+  m.SetContexts("DEV")
+  summary, err := m.Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if summary.Count(Executed) != 2 || summary[2].ID != "grants" || summary[2].Status != Skipped {
+    t.Errorf("expected grants to be skipped got %v", summary)
+  }
+  expected := "CREATE TABLE a (id int);|INSERT INTO a VALUES (1);"
+  if strings.Join(fake.statements(), "|") != expected {
+    t.Errorf("expected %v got %v", expected, fake.statements())
+  }
+
+  // without contexts everything runs
+  summary, err = NewMigrator(db, "ql", rev).Migrate()
+  if err != nil || len(summary) != 1 || summary[0].ID != "grants" || summary[0].Status != Executed {
+    t.Errorf("expected grants to run got %v %v", summary, err)
+  }
+}
+
+func TestMigrateDefaultAttributes(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fake.fail = map[string]error{"bad": errors.New("fake: bad statement")}
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+INSERT INTO bad VALUES (1);
+--+ changeset id:2 author:jgilbert failonerror:true
+CREATE TABLE a (id int);`), path: "/tmp/1.sql"}
+
+  m := NewMigrator(db, "ql", rev)
+  if err := m.SetDefaultAttributes(map[string]string{"Author": "ops", "failonerror": "false"}); err != nil {
+    t.Fatal(err)
+  }
+  summary, err := m.Migrate()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if summary.Count(Failed) != 1 || summary.Count(Executed) != 1 {
+    t.Errorf("expected the first changeset to fail without stopping got %v", summary)
+  }
+  entries, _ := m.History()
+  if len(entries) != 2 || entries[0].Author != "ops" || entries[1].Author != "jgilbert" {
+    t.Errorf("unexpected entries %+v", entries)
+  }
+
+  for _, defaults := range([]map[string]string{
+    {"id": "1"},
+    {"run always": "true"},
+    {"runalways": "sometimes"},
+    {"enddelimiter": ""},
+  }) {
+    if err := m.SetDefaultAttributes(defaults); err == nil {
+      t.Errorf("expected %v to be invalid", defaults)
+    }
+  }
+}
@@ -0,0 +1,111 @@
+package drift
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "errors"
+)
+
+// A Layer is one of the filesystems of an OverlayFS
+type Layer struct {
+  Name string       // reported by Origin, e.g. base or prod
+  FS   FileSystem
+}
+
+// OverlayFS is a FileSystem merging several layers in to one view, so a
+// shared set of revisions can be extended or overridden per environment
+// later layers take precedence, a file in a later layer hides the file or
+// directory at the same path in the layers before it, and directories are
+// merged across every layer they're in
+// e.g. fs := NewOverlayFS(Layer{"base", base}, Layer{"prod", prod})
+//      revs, err := ReadRevisions("migrations", fs)
+//      layer, err := fs.Origin(revs[0].Path())
+type OverlayFS struct {
+  layers []Layer
+}
+
+func NewOverlayFS(layers ...Layer) *OverlayFS {
+  return &OverlayFS{layers: layers}
+}
+
+// the layers from the lowest precedence to the highest
+func (o *OverlayFS) Layers() []Layer { return o.layers }
+
+// finds the layer a path is read from, the highest one it's in
+// files missing from every layer are os.ErrNotExist
+func (o *OverlayFS) find(op string, name string) (int, os.FileInfo, error) {
+  for i := len(o.layers) - 1; i >= 0; i-- {
+    info, err := o.layers[i].FS.Stat(name)
+    if err == nil {
+      return i, info, nil
+    }
+    if !errors.Is(err, os.ErrNotExist) {
+      return -1, nil, err
+    }
+  }
+  return -1, nil, memError(op, name, os.ErrNotExist)
+}
+
+// the name of the layer a file is read from
+func (o *OverlayFS) Origin(name string) (string, error) {
+  i, _, err := o.find("origin", name)
+  if err != nil {
+    return "", err
+  }
+  return o.layers[i].Name, nil
+}
+
+func (o *OverlayFS) Open(name string) (File, error) {
+  i, _, err := o.find("open", name)
+  if err != nil {
+    return nil, err
+  }
+  return o.layers[i].FS.Open(name)
+}
+
+func (o *OverlayFS) Stat(name string) (os.FileInfo, error) {
+  _, info, err := o.find("stat", name)
+  return info, err
+}
+
+// lists a directory merged across the layers, an entry in a later layer
+// hides the same name in the layers before it
+func (o *OverlayFS) ReadDir(name string) ([]os.FileInfo, error) {
+  top, info, err := o.find("readdir", name)
+  if err != nil {
+    return nil, err
+  }
+  if !info.IsDir() {
+    return nil, memError("readdir", name, fmt.Errorf("not a directory"))
+  }
+  entries := make(map[string]os.FileInfo)
+  for i := top; i >= 0; i-- {
+    info, err := o.layers[i].FS.Stat(name)
+    if errors.Is(err, os.ErrNotExist) {
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    // a file hides the directory in the layers below it
+    if !info.IsDir() {
+      break
+    }
+    infos, err := o.layers[i].FS.ReadDir(name)
+    if err != nil {
+      return nil, err
+    }
+    for _, info := range(infos) {
+      if _, ok := entries[info.Name()]; !ok {
+        entries[info.Name()] = info
+      }
+    }
+  }
+  infos := make([]os.FileInfo, 0, len(entries))
+  for _, info := range(entries) {
+    infos = append(infos, info)
+  }
+  sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+  return infos, nil
+}
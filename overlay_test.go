@@ -0,0 +1,84 @@
+package drift
+
+import (
+  "os"
+  "errors"
+  "testing"
+  "io/ioutil"
+)
+
+func testOverlay() *OverlayFS {
+  base, dev, prod := NewMemFS(), NewMemFS(), NewMemFS()
+  base.WriteFile("db/V1.sql", []byte("--+ changeset id:1\nCREATE TABLE a (id int);"), 0644)
+  base.WriteFile("db/V2.sql", []byte("--+ changeset id:2\nCREATE TABLE b (id int);"), 0644)
+  base.WriteFile("db/seed/V1.sql", []byte("--+ changeset id:seed\nINSERT INTO a VALUES (1);"), 0644)
+  dev.WriteFile("db/V3.sql", []byte("--+ changeset id:3\nINSERT INTO b VALUES (1);"), 0644)
+  prod.WriteFile("db/V2.sql", []byte("--+ changeset id:2\nCREATE TABLE b (id bigint);"), 0644)
+  prod.WriteFile("db/V2.5.sql", []byte("--+ changeset id:grants\nGRANT ALL ON b TO app;"), 0644)
+  // prod hides the seed data
+  prod.WriteFile("db/seed", []byte("no seed data"), 0644)
+  return NewOverlayFS(Layer{"base", base}, Layer{"dev", dev}, Layer{"prod", prod})
+}
+
+func TestOverlayFS(t *testing.T) {
+  fs := testOverlay()
+  revisions, err := ReadRevisions("db", fs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if revisionPaths(revisions) != "db/V1.sql|db/V2.sql|db/V2.5.sql|db/V3.sql" {
+    t.Errorf("unexpected revisions %v", revisionPaths(revisions))
+  }
+  for index, expected := range([]string{"base", "prod", "prod", "dev"}) {
+    origin, err := fs.Origin(revisions[index].Path())
+    if err != nil || origin != expected {
+      t.Errorf("expected %v to come from %v got %v %v", revisions[index].Path(), expected, origin, err)
+    }
+  }
+  if string(revisions[1].Data()) != "--+ changeset id:2\nCREATE TABLE b (id bigint);" {
+    t.Errorf("expected the prod revision got %q", revisions[1].Data())
+  }
+
+  f, err := fs.Open("db/seed")
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, _ := ioutil.ReadAll(f)
+  if string(data) != "no seed data" {
+    t.Errorf("expected the seed directory to be hidden got %q", data)
+  }
+  if _, err := fs.ReadDir("db/seed"); err == nil {
+    t.Errorf("expected a hidden directory to not be listed")
+  }
+  if info, err := fs.Stat("db"); err != nil || !info.IsDir() {
+    t.Errorf("expected db to be a directory got %v %v", info, err)
+  }
+  if _, err := fs.Stat("db/V4.sql"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing file to not exist got %v", err)
+  }
+  if _, err := fs.Origin("db/V4.sql"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing file to not exist got %v", err)
+  }
+  if _, err := fs.ReadDir("nowhere"); !errors.Is(err, os.ErrNotExist) {
+    t.Errorf("expected a missing directory to not exist got %v", err)
+  }
+  if len(fs.Layers()) != 3 || fs.Layers()[2].Name != "prod" {
+    t.Errorf("unexpected layers %v", fs.Layers())
+  }
+}
+
+// a directory hidden by a file comes back in a later layer without the
+// files of the layers below it
+func TestOverlayFSHiddenDirectory(t *testing.T) {
+  base, mid, top := NewMemFS(), NewMemFS(), NewMemFS()
+  base.WriteFile("db/a.sql", nil, 0644)
+  mid.WriteFile("db", nil, 0644)
+  top.WriteFile("db/b.sql", nil, 0644)
+  infos, err := NewOverlayFS(Layer{"base", base}, Layer{"mid", mid}, Layer{"top", top}).ReadDir("db")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(infos) != 1 || infos[0].Name() != "b.sql" {
+    t.Errorf("expected only b.sql got %v", infos)
+  }
+}
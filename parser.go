@@ -0,0 +1,417 @@
+package drift
+
+import (
+  "io"
+  "strings"
+)
+
+// the state of a parse over a single revision
+type parser struct {
+  path       string
+  data       []byte     // the whole revision, nil when it's streamed
+  s          *Scanner
+  errors     ParseErrors
+  changesets []*Changeset
+  includes   []include   // include headers before the first changeset
+  defaults   map[string]string   // attributes every changeset header has
+  ids        map[string]bool     // the changeset ids seen so far
+
+  // the changeset being parsed
+  header   changesetHeader
+  headers  []string
+  body     []rune
+  line     int        // the line the sql starts on
+  rollback []string   // inline '--+ rollback' statements
+  preconditions []Precondition
+  onfail        *OnFail
+  delimiter     string   // from a '--+ delimiter' header
+  block    []rune     // the '--+ rollback' block after the sql
+  inblock  bool       // seen the '--+ rollback' block header
+  started bool   // seen the first changeset header
+  inbody  bool   // seen sql after the current changeset headers
+  valid   bool   // the current changeset header parsed without errors
+  skipsql bool   // already complained about sql outside of a changeset
+  done    bool   // parsed to the end of the revision
+  start   *Token // the current changeset header
+  startSnippet string   // the line of the current changeset header when streaming
+}
+
+// parses the changesets out of a revision file
+// a changeset starts at a '--+ changeset' header, owns any '--+' headers that
+// directly follow it and the sql up to the next changeset header
+// rollback sql is either given inline by '--+ rollback <sql>' headers or as a
+// block after the sql, started by '--+ rollback' on its own
+// comments and whitespace before the first changeset are skipped
+// parsing carries on after an error so every problem in the revision is
+// returned together as ParseErrors
+func ParseChangesets(rev *Revision) ([]*Changeset, error){
+  r, err := rev.Changesets()
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  p := r.p
+  for !p.done {
+    p.step()
+  }
+  if len(p.errors) > 0 {
+    return nil, p.errors
+  }
+  return p.changesets, nil
+}
+
+// A ChangesetReader parses the changesets of a revision one at a time
+// only the changeset being parsed is held in memory, so revisions too big to
+// read in whole can be worked through
+type ChangesetReader struct {
+  p      *parser
+  closer io.Closer
+}
+
+// creates a ChangesetReader over revision data read from r
+// path is only used in errors
+func NewChangesetReader(path string, r io.Reader) *ChangesetReader {
+  s := NewReaderScanner(r)
+  // the sql is put back together from every token
+  s.SetTrivia(true)
+  return &ChangesetReader{p: &parser{path: path, s: s}}
+}
+
+// returns the next changeset in the revision, io.EOF once there are no more
+// parse errors are returned as ParseErrors as soon as they are found, Next
+// can be called again to carry on past them, changesets with errors are
+// never returned
+func (r *ChangesetReader) Next() (*Changeset, error) {
+  p := r.p
+  for len(p.changesets) == 0 && len(p.errors) == 0 && !p.done {
+    p.step()
+  }
+  // a changeset is always flushed before the errors of the header after it
+  if len(p.changesets) > 0 {
+    cs := p.changesets[0]
+    p.changesets = p.changesets[1:]
+    return cs, nil
+  }
+  if len(p.errors) > 0 {
+    errs := p.errors
+    p.errors = nil
+    return nil, errs
+  }
+  return nil, io.EOF
+}
+
+// let /* */ comments in the revision nest, see Scanner.SetNestedComments
+// this has to be set before the first call to Next
+func (r *ChangesetReader) SetNestedComments(nested bool) {
+  r.p.s.SetNestedComments(nested)
+}
+
+// let a backslash escape quotes in the revision, see Scanner.SetBackslashEscapes
+// this has to be set before the first call to Next
+func (r *ChangesetReader) SetBackslashEscapes(backslash bool) {
+  r.p.s.SetBackslashEscapes(backslash)
+}
+
+// gives every changeset header the attributes it doesn't give itself, see
+// Migrator.SetDefaultAttributes
+// this has to be set before the first call to Next
+func (r *ChangesetReader) SetDefaultAttributes(defaults map[string]string) {
+  r.p.defaults = defaults
+}
+
+// closes the revision being read, if the reader opened it
+func (r *ChangesetReader) Close() error {
+  if r.closer == nil {
+    return nil
+  }
+  return r.closer.Close()
+}
+
+// records an error, filling in where it came from
+func (p *parser) error(err error) {
+  perr, ok := err.(*ParseError)
+  if !ok {
+    perr = &ParseError{Line: p.s.lineno, Column: p.s.column, Msg: err.Error()}
+  }
+  if len(perr.Path) == 0 {
+    perr.Path = p.path
+  }
+  if len(perr.Snippet) == 0 {
+    perr.Snippet = p.snippet(perr.Line)
+  }
+  p.errors = append(p.errors, perr)
+}
+
+// records an error at the start of a token
+func (p *parser) errorAt(tok *Token, format string, args ...interface{}) {
+  p.error(newParseError(p.path, tok.lineno, tok.column, format, args...))
+}
+
+// the text of a line for an error
+// streamed revisions only have the lines the scanner hasn't discarded
+func (p *parser) snippet(lineno int) string {
+  if p.data != nil {
+    return lineOf(p.data, lineno)
+  }
+  return p.s.line(lineno)
+}
+
+// parses the next token, the last changeset is flushed once the revision
+// runs out
+func (p *parser) step() {
+  if !p.s.HasMoreTokens() {
+    p.flush()
+    p.done = true
+    return
+  }
+  tok, err := p.next()
+  if err != nil {
+    // we can't recover from the scanner failing
+    p.error(err)
+    p.done = true
+    return
+  }
+  // the token has been read so the lines before it aren't needed
+  p.s.discard()
+
+  // '--+' comments are headers
+  if tok.ttype == COMMENT && isHeader(tok.runes) {
+    p.parseHeader(tok)
+    return
+  }
+
+  if !p.started {
+    // only comments and whitespace may come before the first changeset
+    if tok.ttype != COMMENT && tok.ttype != WHITESPACE && !p.skipsql {
+      p.errorAt(tok, "sql found outside of a changeset")
+      p.skipsql = true
+    }
+    return
+  }
+  if p.inblock {
+    p.block = append(p.block, tok.runes...)
+    return
+  }
+  // whitespace between the headers and the sql is not part of the sql
+  if !p.inbody && tok.ttype == WHITESPACE {
+    return
+  }
+  if !p.inbody {
+    p.line = tok.lineno
+  }
+  p.inbody = true
+  p.body = append(p.body, tok.runes...)
+}
+
+// scans the next token
+// a custom delimiter is a token of its own, so $$ or // end a statement
+// rather than starting a dollar quote or a comment, see delimiterAt
+func (p *parser) next() (*Token, error) {
+  delimiter := p.header.endDelimiter
+  if len(p.delimiter) > 0 {
+    delimiter = p.delimiter
+  }
+  if d := []rune(delimiter); p.started && delimiterAt(p.s, d) {
+    tok := &Token{
+      runes:  d,
+      ttype:  IDENT,
+      offset: p.s.offset,
+      lineno: p.s.lineno,
+      column: p.s.column,
+    }
+    return tok, p.s.seek(p.s.offset + int64(len(d)))
+  }
+  return p.s.NextToken()
+}
+
+func (p *parser) parseHeader(tok *Token) {
+  if headerName(tok.runes) == "changeset" {
+    p.flush()
+    header, err := parseChangesetHeader(p.path, tok, p.defaults)
+    if err != nil {
+      p.error(err)
+    } else if p.ids[header.id] {
+      // the history is keyed on path::id so the ids have to be unique
+      err = newParseError(p.path, tok.lineno, tok.column, "duplicate changeset id '%s'", header.id)
+      p.error(err)
+    } else {
+      if p.ids == nil {
+        p.ids = make(map[string]bool)
+      }
+      p.ids[header.id] = true
+    }
+    p.header = header
+    p.valid = err == nil
+    p.started = true
+    p.skipsql = false
+    p.start = tok
+    if p.data == nil {
+      p.startSnippet = p.s.line(tok.lineno)
+    }
+    return
+  }
+  // includes are read by ReadChangelog
+  if isInclude(headerName(tok.runes)) {
+    if p.started {
+      p.errorAt(tok, "%s found after the first changeset", headerName(tok.runes))
+      return
+    }
+    inc, err := parseInclude(p.path, tok)
+    if err != nil {
+      p.error(err)
+      return
+    }
+    p.includes = append(p.includes, inc)
+    return
+  }
+  if !p.started {
+    p.errorAt(tok, "header found outside of a changeset")
+    return
+  }
+  if p.inblock {
+    p.errorAt(tok, "header found in rollback block")
+    return
+  }
+  // '--+ rollback' on its own starts a block running to the next changeset
+  if headerName(tok.runes) == "rollback" && len(headerValue(tok.runes)) == 0 {
+    p.inblock = true
+    p.headers = append(p.headers, string(tok.runes))
+    return
+  }
+  if p.inbody {
+    p.errorAt(tok, "header found after changeset sql")
+    return
+  }
+  switch headerName(tok.runes) {
+  case "rollback":
+    p.rollback = append(p.rollback, headerValue(tok.runes))
+  case "preconditions":
+    preconditions, onfail, err := parsePreconditions(p.path, tok)
+    if err != nil {
+      p.error(err)
+      p.valid = false
+      break
+    }
+    if onfail != nil && p.onfail != nil {
+      p.errorAt(tok, "onfail given more than once")
+      p.valid = false
+      break
+    }
+    if onfail != nil {
+      p.onfail = onfail
+    }
+    p.preconditions = append(p.preconditions, preconditions...)
+  case "delimiter":
+    delimiter, err := p.parseDelimiter(tok)
+    if err != nil {
+      p.error(err)
+      p.valid = false
+      break
+    }
+    p.delimiter = delimiter
+  case "precondition-sql-check":
+    precondition, err := parseSQLCheck(p.path, tok)
+    if err != nil {
+      p.error(err)
+      p.valid = false
+      break
+    }
+    p.preconditions = append(p.preconditions, precondition)
+  }
+  p.headers = append(p.headers, string(tok.runes))
+}
+
+// parses a '--+ delimiter <delimiter>' header, the delimiter can be given by
+// the header or the enddelimiter attribute but not both
+func (p *parser) parseDelimiter(tok *Token) (string, error) {
+  delimiter := headerValue(tok.runes)
+  if len(delimiter) == 0 {
+    return "", newParseError(p.path, tok.lineno, tok.column, "delimiter is missing")
+  }
+  if strings.ContainsAny(delimiter, " \t") {
+    return "", newParseError(p.path, tok.lineno, tok.column, "invalid delimiter '%s'", delimiter)
+  }
+  if len(p.delimiter) > 0 || len(p.header.endDelimiter) > 0 {
+    return "", newParseError(p.path, tok.lineno, tok.column, "delimiter given more than once")
+  }
+  return delimiter, nil
+}
+
+// closes out the current changeset and adds it to the result
+func (p *parser) flush() {
+  if !p.started {
+    return
+  }
+  sql := strings.TrimSpace(string(p.body))
+  if len(sql) == 0 {
+    // a streamed header's line may have been discarded by now
+    err := newParseError(p.path, p.start.lineno, p.start.column, "changeset has no sql")
+    err.Snippet = p.startSnippet
+    p.error(err)
+  } else if p.valid {
+    rollback := p.rollback
+    if block := strings.TrimSpace(string(p.block)); len(block) > 0 {
+      rollback = append(rollback, block)
+    }
+    cs := &Changeset{
+      header:        p.header,
+      headers:       p.headers,
+      sql:           sql,
+      line:          p.line,
+      rollback:      strings.Join(rollback, "\n"),
+      preconditions: p.preconditions,
+      nested:        p.s.nested,
+      backslash:     p.s.backslash,
+    }
+    if p.onfail != nil {
+      cs.onFail = *p.onfail
+    }
+    cs.delimiter = p.header.endDelimiter
+    if len(p.delimiter) > 0 {
+      cs.delimiter = p.delimiter
+    }
+    if len(cs.delimiter) == 0 {
+      cs.delimiter = DefaultDelimiter
+    }
+    if p.header.splitStatements {
+      cs.statements = splitStatements(cs.sql, cs.delimiter, cs.nested, cs.backslash)
+      cs.rollbacks = splitStatements(cs.rollback, cs.delimiter, cs.nested, cs.backslash)
+    } else {
+      cs.statements = []string{cs.sql}
+      if len(cs.rollback) > 0 {
+        cs.rollbacks = []string{cs.rollback}
+      }
+    }
+    p.changesets = append(p.changesets, cs)
+  }
+  p.headers = nil
+  p.body = nil
+  p.inbody = false
+  p.rollback = nil
+  p.preconditions = nil
+  p.onfail = nil
+  p.delimiter = ""
+  p.block = nil
+  p.inblock = false
+}
+
+// test for comments starting with '--+'
+func isHeader(runes []rune) bool {
+  return len(runes) >= 3 && runes[0] == '-' && runes[1] == '-' && runes[2] == '+'
+}
+
+// returns the first word after the '--+' of a header
+func headerName(runes []rune) string {
+  fields := strings.Fields(string(runes[3:]))
+  if len(fields) < 1 {
+    return ""
+  }
+  return fields[0]
+}
+
+// returns everything after the first word of a header
+func headerValue(runes []rune) string {
+  text := strings.TrimSpace(string(runes[3:]))
+  name := headerName(runes)
+  return strings.TrimSpace(text[len(name):])
+}
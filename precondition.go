@@ -0,0 +1,188 @@
+package drift
+
+import (
+  "fmt"
+  "strings"
+)
+
+// what to do with a changeset whose preconditions fail
+type OnFail int
+
+const (
+  OnFailHalt OnFail = iota   // stop the migration
+  OnFailMarkRan              // don't run the changeset but record it as applied
+  OnFailWarn                 // run the changeset anyway and report a warning
+  OnFailContinue             // don't run the changeset, try it again next migration
+)
+
+func (o OnFail) String() string {
+  switch o {
+  case OnFailHalt:
+    return "halt"
+  case OnFailMarkRan:
+    return "markran"
+  case OnFailWarn:
+    return "warn"
+  case OnFailContinue:
+    return "continue"
+  }
+  return fmt.Sprintf("OnFail(%d)", int(o))
+}
+
+// turns an onfail attribute value in to an OnFail
+func parseOnFail(s string) (OnFail, bool) {
+  for _, o := range([]OnFail{OnFailHalt, OnFailMarkRan, OnFailWarn, OnFailContinue}) {
+    if strings.EqualFold(o.String(), s) {
+      return o, true
+    }
+  }
+  return OnFailHalt, false
+}
+
+// A Precondition is a check made against the database before a changeset runs
+// e.g. --+ preconditions dbms:ql tableexists:tablename colexists:tablename.colname
+//      --+ precondition-sql-check expectedResult:0 select count(*) from mytable
+type Precondition struct {
+  Kind     string   // dbms, tableexists, colexists, fkexists, indexexists or sqlcheck
+  Value    string   // the name checked for, or the sql of a sqlcheck
+  Expected string   // the result a sqlcheck should return
+}
+
+func (p Precondition) String() string {
+  if p.Kind == "sqlcheck" {
+    return fmt.Sprintf("sqlcheck (%s) expected %s", p.Value, p.Expected)
+  }
+  return fmt.Sprintf("%s:%s", p.Kind, p.Value)
+}
+
+// parses a '--+ preconditions' header
+// every attribute other than onfail is a precondition, values can be comma
+// separated lists in which case every item has to pass
+// returns the onfail attribute if one was given
+func parsePreconditions(path string, tok *Token) ([]Precondition, *OnFail, error) {
+  var preconditions []Precondition
+  var onfail *OnFail
+  attrs, err := parseAttributes(path, tok, headerArguments(tok))
+  if err != nil {
+    return nil, nil, err
+  }
+
+  for _, attr := range(attrs) {
+    switch attr.key {
+    case "onfail":
+      o, ok := parseOnFail(attr.value)
+      if !ok {
+        return nil, nil, newParseError(path, tok.lineno, attr.column,
+          "invalid onfail '%s' expected halt, markran, warn or continue", attr.value)
+      }
+      onfail = &o
+    case "dbms":
+      preconditions = append(preconditions, Precondition{Kind: attr.key, Value: attr.value})
+    case "tableexists", "colexists", "fkexists", "indexexists":
+      names := splitList(attr.value)
+      if len(names) == 0 {
+        return nil, nil, newParseError(path, tok.lineno, attr.column, "%s is missing a name", attr.key)
+      }
+      for _, name := range(names) {
+        preconditions = append(preconditions, Precondition{Kind: attr.key, Value: name})
+      }
+    default:
+      return nil, nil, newParseError(path, tok.lineno, attr.column, "unknown precondition '%s'", attr.key)
+    }
+  }
+  return preconditions, onfail, nil
+}
+
+// parses a '--+ precondition-sql-check expectedResult:<value> <sql>' header
+func parseSQLCheck(path string, tok *Token) (Precondition, error) {
+  args := headerArguments(tok)
+  if len(args) == 0 {
+    return Precondition{}, newParseError(path, tok.lineno, tok.column, "precondition-sql-check is missing expectedresult")
+  }
+  key, value, ok := splitAttribute(args[0].text)
+  if !ok || key != "expectedresult" {
+    return Precondition{}, newParseError(path, tok.lineno, args[0].column,
+      "expected expectedresult:<value> got '%s'", args[0].text)
+  }
+  if len(args) < 2 {
+    return Precondition{}, newParseError(path, tok.lineno, tok.column, "precondition-sql-check is missing sql")
+  }
+  // the sql is the rest of the header as written
+  sql := strings.TrimSpace(string(tok.runes[args[1].column - tok.column:]))
+  return Precondition{Kind: "sqlcheck", Value: sql, Expected: value}, nil
+}
+
+// A PreconditionError is a changeset that was halted by a failed precondition
+type PreconditionError struct {
+  Path         string
+  ID           string
+  Precondition Precondition
+}
+
+func (e *PreconditionError) Error() string {
+  return fmt.Sprintf("%s: changeset %s: precondition %s failed", e.Path, e.ID, e.Precondition)
+}
+
+// checks the preconditions of a changeset against the database, returning the
+// first one that fails or nil if they all pass
+// errors are returned for checks the database can't make
+func (m *Migrator) check(cs *Changeset) (*Precondition, error) {
+  for _, p := range(cs.Preconditions()) {
+    ok, err := m.holds(p)
+    if err != nil {
+      return nil, fmt.Errorf("precondition %s: %v", p, err)
+    }
+    if !ok {
+      return &p, nil
+    }
+  }
+  return nil, nil
+}
+
+// test if a single precondition holds
+func (m *Migrator) holds(p Precondition) (bool, error) {
+  switch p.Kind {
+  case "dbms":
+    for _, dbms := range(splitList(p.Value)) {
+      if strings.EqualFold(dbms, m.dbms) {
+        return true, nil
+      }
+    }
+    return false, nil
+  case "tableexists":
+    return m.exists(m.dialect.TableExists, p.Value)
+  case "colexists":
+    // table.column or a column in any table
+    i := strings.LastIndex(p.Value, ".")
+    if i < 0 {
+      return m.exists(m.dialect.AnyColumnExists, p.Value)
+    }
+    return m.exists(m.dialect.ColumnExists, p.Value[:i], p.Value[i+1:])
+  case "fkexists":
+    return m.exists(m.dialect.ForeignKeyExists, p.Value)
+  case "indexexists":
+    return m.exists(m.dialect.IndexExists, p.Value)
+  case "sqlcheck":
+    var result interface{}
+    if err := m.db.QueryRow(p.Value).Scan(&result); err != nil {
+      return false, err
+    }
+    if b, ok := result.([]byte); ok {
+      result = string(b)
+    }
+    return fmt.Sprint(result) == p.Expected, nil
+  }
+  return false, fmt.Errorf("unknown precondition")
+}
+
+// runs a count query from the dialect, true if it counts anything
+func (m *Migrator) exists(query string, args ...interface{}) (bool, error) {
+  if len(query) == 0 {
+    return false, fmt.Errorf("not supported by the %s dialect", m.dialect.Name)
+  }
+  var count int64
+  if err := m.db.QueryRow(query, args...).Scan(&count); err != nil {
+    return false, err
+  }
+  return count > 0, nil
+}
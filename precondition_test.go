@@ -0,0 +1,230 @@
+package drift
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+  "database/sql/driver"
+)
+
+func TestParsePreconditions(t *testing.T) {
+  data := `--+ preconditions dbms:ql tableexists:a, b colexists:colname fkexists:fkname indexexists:a.idx onfail:MarkRan`
+  preconditions, onfail, err := parsePreconditions("/tmp/1.sql", scanHeader(t, data))
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  var got []string
+  for _, p := range(preconditions) {
+    got = append(got, p.String())
+  }
+  expected := "dbms:ql|tableexists:a|tableexists:b|colexists:colname|fkexists:fkname|indexexists:a.idx"
+  if strings.Join(got, "|") != expected {
+    t.Errorf("expected %v got %v", expected, strings.Join(got, "|"))
+  }
+  if onfail == nil || *onfail != OnFailMarkRan {
+    t.Errorf("expected onfail %v got %v", OnFailMarkRan, onfail)
+  }
+}
+
+func TestParsePreconditionsBad(t *testing.T) {
+  for data, expected := range(map[string]string{
+    `--+ preconditions onfail:explode`:         "/tmp/1.sql:1:19: invalid onfail 'explode' expected halt, markran, warn or continue",
+    `--+ preconditions tableexists:`:           "/tmp/1.sql:1:19: tableexists is missing a name",
+    `--+ preconditions rowexists:a`:            "/tmp/1.sql:1:19: unknown precondition 'rowexists'",
+    `--+ preconditions dbms:ql dbms:postgres`:  "/tmp/1.sql:1:27: duplicate attribute 'dbms'",
+  }) {
+    _, _, err := parsePreconditions("/tmp/1.sql", scanHeader(t, data))
+    if err == nil {
+      t.Errorf("expected an error parsing '%v'", data)
+      continue
+    }
+    if err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err.Error())
+    }
+  }
+}
+
+func TestParseSQLCheck(t *testing.T) {
+  data := `--+ precondition-sql-check expectedResult:0 select   count(*) from mytable`
+  p, err := parseSQLCheck("/tmp/1.sql", scanHeader(t, data))
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if p.Kind != "sqlcheck" || p.Expected != "0" || p.Value != "select   count(*) from mytable" {
+    t.Errorf("unexpected precondition %+v", p)
+  }
+
+  for data, expected := range(map[string]string{
+    `--+ precondition-sql-check`:                      "/tmp/1.sql:1:1: precondition-sql-check is missing expectedresult",
+    `--+ precondition-sql-check select 1`:             "/tmp/1.sql:1:28: expected expectedresult:<value> got 'select'",
+    `--+ precondition-sql-check expectedresult:1`:     "/tmp/1.sql:1:1: precondition-sql-check is missing sql",
+  }) {
+    _, err := parseSQLCheck("/tmp/1.sql", scanHeader(t, data))
+    if err == nil {
+      t.Errorf("expected an error parsing '%v'", data)
+      continue
+    }
+    if err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err.Error())
+    }
+  }
+}
+
+func TestParseChangesetsPreconditions(t *testing.T) {
+  data := `
+--+ changeset id:1
+--+ preconditions tableexists:a onfail:warn
+--+ precondition-sql-check expectedResult:0 SELECT count(*) FROM a
+--+ preconditions colexists:a.id
+INSERT INTO a VALUES (1);
+--+ changeset id:2
+SELECT 1;
+--+ changeset id:3
+--+ preconditions onfail:continue
+--+ preconditions onfail:halt
+SELECT 1;`
+  _, err := ParseChangesets(&Revision{data: []byte(data), path: "/tmp/1.sql"})
+  if err == nil || err.Error() != "/tmp/1.sql:11:1: onfail given more than once" {
+    t.Fatalf("unexpected error %v", err)
+  }
+
+  changesets, err := ParseChangesets(&Revision{data: []byte(data[:strings.Index(data, "--+ changeset id:3")]), path: "/tmp/1.sql"})
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(changesets[0].Preconditions()) != 3 || changesets[0].OnFail() != OnFailWarn {
+    t.Errorf("unexpected preconditions %v %v", changesets[0].Preconditions(), changesets[0].OnFail())
+  }
+  if changesets[0].Preconditions()[1].Value != "SELECT count(*) FROM a" {
+    t.Errorf("unexpected sql check %v", changesets[0].Preconditions()[1])
+  }
+  if len(changesets[1].Preconditions()) != 0 || changesets[1].OnFail() != OnFailHalt {
+    t.Errorf("unexpected preconditions %v %v", changesets[1].Preconditions(), changesets[1].OnFail())
+  }
+}
+
+// answers precondition queries as if only table a with column id exists
+func answerTables(query string, args []driver.Value) (driver.Value, error) {
+  switch {
+  case strings.Contains(query, "__Table"):
+    if args[0] == "a" {
+      return int64(1), nil
+    }
+    return int64(0), nil
+  case strings.Contains(query, "__Column"):
+    if args[0] == "a" && args[1] == "id" {
+      return int64(1), nil
+    }
+    return int64(0), nil
+  case strings.HasPrefix(query, "SELECT count(*) FROM a"):
+    return []byte("2"), nil
+  }
+  return nil, fmt.Errorf("fake: unexpected query %s", query)
+}
+
+func TestMigratePreconditions(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fake.answer = answerTables
+  rev := &Revision{data: []byte(`
+--+ changeset id:passes
+--+ preconditions dbms:ql, postgres tableexists:a colexists:a.id
+--+ precondition-sql-check expectedresult:2 SELECT count(*) FROM a
+SELECT 1;
+--+ changeset id:warns
+--+ preconditions tableexists:b onfail:warn
+SELECT 2;
+--+ changeset id:continues
+--+ preconditions tableexists:b onfail:continue
+SELECT 3;
+--+ changeset id:marks
+--+ precondition-sql-check expectedresult:0 SELECT count(*) FROM a
+--+ preconditions onfail:markran
+SELECT 4;
+--+ changeset id:halts
+--+ preconditions colexists:a.name
+SELECT 5;
+--+ changeset id:never
+SELECT 6;`), path: "/tmp/1.sql"}
+
+  m := NewMigrator(db, "ql", rev)
+  summary, err := m.Migrate()
+  perr, ok := err.(*PreconditionError)
+  if !ok {
+    t.Fatalf("expected a PreconditionError got %v", err)
+  }
+  if perr.ID != "halts" || perr.Precondition.String() != "colexists:a.name" {
+    t.Errorf("unexpected error %v", perr)
+  }
+  for index, value := range([]struct{
+    id      string
+    status  Status
+    warning bool
+  }{
+    {"passes", Executed, false},
+    {"warns", Executed, true},
+    {"continues", Skipped, true},
+    {"marks", MarkedRan, true},
+    {"halts", Failed, false},
+  }) {
+    if index >= len(summary) {
+      t.Fatalf("expected %v results got %v", 5, summary)
+    }
+    r := summary[index]
+    if r.ID != value.id || r.Status != value.status || (len(r.Warning) > 0) != value.warning {
+      t.Errorf("expected %v %v got %v", value.id, value.status, r)
+    }
+  }
+  if strings.Join(fake.statements(), "|") != "SELECT 1;|SELECT 2;" {
+    t.Errorf("unexpected statements %v", fake.statements())
+  }
+
+  // marked changesets count as applied, continued ones are still pending
+  pending, err := m.Pending()
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  var ids []string
+  for _, p := range(pending) {
+    ids = append(ids, p.Changeset.ID())
+  }
+  if strings.Join(ids, "|") != "continues|halts|never" {
+    t.Errorf("unexpected pending changesets %v", ids)
+  }
+}
+
+func TestMigratePreconditionUnsupported(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fake.answer = answerTables
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+--+ preconditions fkexists:a_fk onfail:continue
+SELECT 1;`), path: "/tmp/1.sql"}
+  _, err := NewMigrator(db, "ql", rev).Migrate()
+  if err == nil || !strings.HasSuffix(err.Error(), "precondition fkexists:a_fk: not supported by the ql dialect") {
+    t.Errorf("unexpected error %v", err)
+  }
+}
+
+// rolling back a changeset marked as ran only removes its entry
+func TestRollbackMarkedRan(t *testing.T) {
+  db, fake := newFakeDB(t)
+  fake.answer = answerTables
+  rev := &Revision{data: []byte(`
+--+ changeset id:1
+--+ preconditions tableexists:b onfail:markran
+SELECT 1;`), path: "/tmp/1.sql"}
+  m := NewMigrator(db, "ql", rev)
+  if _, err := m.Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  summary, err := m.Rollback(1)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(summary) != 1 || summary[0].Status != RolledBack {
+    t.Errorf("unexpected summary %v", summary)
+  }
+  if len(fake.statements()) != 0 || len(fake.history) != 0 {
+    t.Errorf("expected nothing to run got %v %v", fake.statements(), fake.history)
+  }
+}
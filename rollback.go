@@ -0,0 +1,114 @@
+package drift
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "database/sql"
+)
+
+// undoes the last count applied changesets, most recent first
+func (m *Migrator) Rollback(count int) (Summary, error) {
+  if count < 0 {
+    return nil, fmt.Errorf("can't roll back %d changesets", count)
+  }
+  return m.rollback(func(entries []*HistoryEntry) ([]*HistoryEntry, error) {
+    if count > len(entries) {
+      count = len(entries)
+    }
+    return entries[len(entries) - count:], nil
+  })
+}
+
+// undoes every changeset applied after the changeset with the given id,
+// most recent first, the changeset itself stays applied
+// the id can be qualified with the revision path as path::id, otherwise the
+// most recently applied changeset with that id is used
+func (m *Migrator) RollbackTo(id string) (Summary, error) {
+  return m.rollback(func(entries []*HistoryEntry) ([]*HistoryEntry, error) {
+    for i := len(entries) - 1; i >= 0; i-- {
+      e := entries[i]
+      if e.ID == id || historyKey(e.Path, e.ID) == id {
+        return entries[i + 1:], nil
+      }
+    }
+    return nil, fmt.Errorf("changeset %s has not been applied", id)
+  })
+}
+
+// rolls back the applied entries picked out by choose
+// every picked changeset has to be found in the revisions and have rollback
+// sql before anything is run, a failing rollback stops straight away
+// changesets marked as ran by a precondition only have their entry removed
+func (m *Migrator) rollback(choose func([]*HistoryEntry) ([]*HistoryEntry, error)) (Summary, error) {
+  all, err := m.changesets()
+  if err != nil {
+    return nil, err
+  }
+  h, err := m.history(true)
+  if err != nil {
+    return nil, err
+  }
+  entries, err := h.entries()
+  if err != nil {
+    return nil, err
+  }
+
+  var appliedEntries []*HistoryEntry
+  for _, e := range(entries) {
+    if e.Status.applied() {
+      appliedEntries = append(appliedEntries, e)
+    }
+  }
+  chosen, err := choose(appliedEntries)
+  if err != nil {
+    return nil, err
+  }
+
+  changesets := make(map[string]*Changeset)
+  for _, p := range(all) {
+    changesets[historyKey(p.Revision.path, p.Changeset.ID())] = p.Changeset
+  }
+  var missing []string
+  for _, e := range(chosen) {
+    cs, ok := changesets[historyKey(e.Path, e.ID)]
+    if !ok {
+      missing = append(missing, fmt.Sprintf("%s: changeset %s is not in the revisions", e.Path, e.ID))
+    } else if len(cs.Rollback()) == 0 && e.Status != MarkedRan {
+      missing = append(missing, fmt.Sprintf("%s: changeset %s has no rollback", e.Path, e.ID))
+    }
+  }
+  if len(missing) > 0 {
+    return nil, fmt.Errorf("can't roll back: %s", strings.Join(missing, ", "))
+  }
+
+  var summary Summary
+  for i := len(chosen) - 1; i >= 0; i-- {
+    e := chosen[i]
+    cs := changesets[historyKey(e.Path, e.ID)]
+    start := time.Now()
+    // changesets marked as ran never ran so there's nothing to undo
+    var statements []string
+    if e.Status != MarkedRan {
+      statements = cs.RollbackStatements()
+    }
+    result := &Result{Path: e.Path, ID: e.ID, Status: RolledBack}
+    summary = append(summary, result)
+    err := m.run(statements, func(tx *sql.Tx, ran int, err error) error {
+      result.Duration = time.Since(start)
+      if err != nil {
+        result.Status = Failed
+        result.Err = err
+        return nil
+      }
+      return h.delete(tx, e.Path, e.ID)
+    })
+    if err != nil {
+      return summary, err
+    }
+    if result.Status == Failed {
+      return summary, &ExecError{e.Path, e.ID, result.Err}
+    }
+  }
+  return summary, nil
+}
@@ -0,0 +1,145 @@
+package drift
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+// a revision of changesets a to e, c can't be rolled back
+func rollbackRevision() *Revision {
+  return &Revision{data: []byte(`
+--+ changeset id:a
+--+ rollback DROP TABLE a;
+CREATE TABLE a (id int);
+--+ changeset id:b
+CREATE TABLE b (id int);
+--+ rollback
+DROP TABLE b;
+--+ changeset id:c
+INSERT INTO a VALUES (1);
+--+ changeset id:d
+--+ rollback DROP TABLE d;
+CREATE TABLE d (id int);
+--+ changeset id:e
+--+ rollback DROP TABLE e;
+CREATE TABLE e (id int);`), path: "/tmp/1.sql"}
+}
+
+func TestRollback(t *testing.T) {
+  db, fake := newFakeDB(t)
+  m := NewMigrator(db, "ql", rollbackRevision())
+  if _, err := m.Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+
+  summary, err := m.Rollback(2)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(summary) != 2 || summary[0].ID != "e" || summary[1].ID != "d" {
+    t.Errorf("expected e and d to be rolled back got %v", summary)
+  }
+  if summary.Count(RolledBack) != 2 {
+    t.Errorf("unexpected summary %v", summary)
+  }
+  statements := fake.statements()
+  if strings.Join(statements[5:], "|") != "DROP TABLE e;|DROP TABLE d;" {
+    t.Errorf("unexpected statements %v", statements[5:])
+  }
+  entries, _ := m.History()
+  if len(entries) != 3 || entries[2].ID != "c" {
+    t.Errorf("expected a, b and c to still be applied got %v", entries)
+  }
+  // the rolled back changesets are pending again
+  pending, _ := m.Pending()
+  if len(pending) != 2 || pending[0].Changeset.ID() != "d" || pending[1].Changeset.ID() != "e" {
+    t.Errorf("expected d and e to be pending got %v", pending)
+  }
+
+  // c has no rollback so nothing is run
+  _, err = m.Rollback(2)
+  if err == nil || err.Error() != "can't roll back: /tmp/1.sql: changeset c has no rollback" {
+    t.Errorf("unexpected error %v", err)
+  }
+  if len(fake.statements()) != 7 {
+    t.Errorf("expected nothing to run got %v", fake.statements()[7:])
+  }
+
+  // rolling back nothing is fine
+  summary, err = m.Rollback(0)
+  if err != nil || len(summary) != 0 {
+    t.Errorf("expected nothing to roll back got %v %v", summary, err)
+  }
+}
+
+func TestRollbackTo(t *testing.T) {
+  db, fake := newFakeDB(t)
+  m := NewMigrator(db, "ql", rollbackRevision())
+  if _, err := m.Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+
+  summary, err := m.RollbackTo("/tmp/1.sql::c")
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(summary) != 2 || summary[0].ID != "e" || summary[1].ID != "d" {
+    t.Errorf("expected e and d to be rolled back got %v", summary)
+  }
+
+  if _, err := m.RollbackTo("missing"); err == nil {
+    t.Errorf("expected an error rolling back to an unknown changeset")
+  }
+
+  // a failing rollback stops straight away and keeps its history
+  if _, err := m.Migrate(); err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  boom := errors.New("boom")
+  fake.fail["DROP TABLE d"] = boom
+  summary, err = m.RollbackTo("c")
+  if !errors.Is(err, boom) {
+    t.Errorf("expected the rollback to fail got %v", err)
+  }
+  if len(summary) != 2 || summary[0].Status != RolledBack || summary[1].Status != Failed {
+    t.Errorf("unexpected summary %v", summary)
+  }
+  entries, _ := m.History()
+  if len(entries) != 4 || entries[3].ID != "d" {
+    t.Errorf("expected a to d to still be applied got %v", entries)
+  }
+}
+
+// changesets that run again keep their place, so a runalways changeset
+// without rollback sql doesn't get in the way of rolling back by count
+func TestRollbackRunAlways(t *testing.T) {
+  db, fake := newFakeDB(t)
+  m := NewMigrator(db, "ql", &Revision{data: []byte(`
+--+ changeset id:views runalways:true
+CREATE VIEW v AS SELECT 1;
+--+ changeset id:a
+--+ rollback DROP TABLE a;
+CREATE TABLE a (id int);`), path: "/tmp/1.sql"})
+  for run := 0; run < 2; run++ {
+    if _, err := m.Migrate(); err != nil {
+      t.Fatalf("unexpected error %v", err)
+    }
+  }
+
+  summary, err := m.Rollback(1)
+  if err != nil {
+    t.Fatalf("unexpected error %v", err)
+  }
+  if len(summary) != 1 || summary[0].ID != "a" {
+    t.Errorf("expected a to be rolled back got %v", summary)
+  }
+  statements := fake.statements()
+  if statements[len(statements) - 1] != "DROP TABLE a;" {
+    t.Errorf("unexpected statements %v", statements)
+  }
+  entries, _ := m.History()
+  if len(entries) != 1 || entries[0].ID != "views" || entries[0].Order != 1 {
+    t.Errorf("expected views to still be applied got %v", entries)
+  }
+}
@@ -2,8 +2,12 @@ package drift
 
 import (
   "io"
+  "fmt"
+  "sort"
   "bytes"
-  "errors"
+  "bufio"
+  "strings"
+  "unicode"
 )
 
 const (
@@ -11,47 +15,154 @@ const (
   IDENT
   COMMENT
   WHITESPACE
+  STRING          // 'single quoted'
+  QUOTEDIDENT     // "double quoted"
+  BACKTICKIDENT   // `backtick quoted`
+  DOLLARQUOTED    // $tag$dollar quoted$tag$
 )
 
-type token struct {
+// A Token is a run of runes consumed by the Scanner
+type Token struct {
   runes  []rune
   ttype  int
   offset int64  // starting offset (in runes not bytes) token was consumed at
   lineno int    // starting lineno the token was consumed from
+  column int    // starting column (in runes) the token was consumed from
 }
 
-type scanner struct {
-  reader *bytes.Reader
+// the token text
+func (t *Token) Runes() []rune { return t.runes }
+// one of IDENT, COMMENT, WHITESPACE or a quoted type
+func (t *Token) Type() int { return t.ttype }
+func (t *Token) Offset() int64 { return t.offset }
+func (t *Token) Lineno() int { return t.lineno }
+func (t *Token) Column() int { return t.column }
+
+// A Scanner splits revision data into tokens
+// runes are decoded from the reader once, as they are needed, and kept so the
+// scanner can move back and forth through them without rereading the reader
+// runes before the current line can be discarded to keep memory down when
+// streaming, after which the scanner can't seek back to them
+type Scanner struct {
+  reader io.RuneReader
+  runes  []rune    // the runes decoded from the reader and not yet discarded
+  base   int64     // the offset of runes[0]
+  lines  []int64   // the offset each line starts at, lines[0] is line first+1
+  first  int       // the number of lines discarded from the line index
+  eof    bool      // the reader has been read to the end
+  trivia bool      // NextToken returns whitespace and comments too
+  nested bool      // block comments nest
+  backslash bool   // a backslash escapes the next rune in '' and "" quotes
   offset int64
   lineno int
+  column int
 }
 
-func NewScanner(b []byte) (*scanner) {
-  return &scanner{
-    reader: bytes.NewReader(b),
+// only discard once there's this many runes to drop, so the buffer isn't
+// shuffled down after every token
+const discardSize = 4096
+
+func NewScanner(b []byte) (*Scanner) {
+  return NewReaderScanner(bytes.NewReader(b))
+}
+
+// creates a Scanner that decodes runes from r as they are needed
+// readers that aren't an io.RuneReader are buffered
+func NewReaderScanner(r io.Reader) (*Scanner) {
+  rr, ok := r.(io.RuneReader)
+  if !ok {
+    rr = bufio.NewReader(r)
+  }
+  return &Scanner{
+    reader: rr,
+    lines:  []int64{0},
     offset: 0,
     lineno: 1,
+    column: 1,
   }
 }
 
+// the offset just past the last rune decoded
+func (s *Scanner) end() int64 {
+  return s.base + int64(len(s.runes))
+}
+
+// decodes runes from the reader until the offset count has been decoded
+// or the reader runs out, running out is not an error
+func (s *Scanner) fill(count int64) error {
+  for !s.eof && s.end() < count {
+    ch, _, err := s.reader.ReadRune()
+    if err != nil {
+      if err == io.EOF {
+        s.eof = true
+        return nil
+      }
+      return err
+    }
+    s.runes = append(s.runes, ch)
+    if ch == '\n' {
+      s.lines = append(s.lines, s.end())
+    }
+  }
+  return nil
+}
+
+// drops the runes before the start of the current line
+// the current line is kept so errors on it can still show it
+func (s *Scanner) discard() {
+  line := s.lineno - 1 - s.first
+  start := s.lines[line]
+  if start - s.base < discardSize {
+    return
+  }
+  n := copy(s.runes, s.runes[start - s.base:])
+  s.runes = s.runes[:n]
+  s.base = start
+  n = copy(s.lines, s.lines[line:])
+  s.lines = s.lines[:n]
+  s.first += line
+}
+
+// the text of a line without its line ending
+// empty if the line has been discarded or doesn't exist
+func (s *Scanner) line(lineno int) string {
+  line := lineno - 1 - s.first
+  if line < 0 || line >= len(s.lines) || s.lines[line] < s.base {
+    return ""
+  }
+  // read up to the end of the line
+  for line + 1 >= len(s.lines) && !s.eof {
+    if err := s.fill(s.end() + 1); err != nil {
+      break
+    }
+  }
+  end := s.end()
+  if line + 1 < len(s.lines) {
+    end = s.lines[line + 1] - 1
+  }
+  return strings.TrimRight(string(s.runes[s.lines[line] - s.base:end - s.base]), "\r")
+}
+
 // This method reads the next rune from the buffer
 // if we read EOF then we will return EOF, io.EOF,
 // if it's an error we will return NUL, and the error
 // otherwise we'll return the next rune (which can be 1-4 bytes)
-// This method will also keep track of the current linenumber in the buffer
-// and the byte offset in the buffer
-func (s *scanner) next() ([]rune, error)  {
-  ch, _, err := s.reader.ReadRune()
-  if err != nil {
-    if err != io.EOF {
-      return []rune{rune(0)}, err
-    }
-    // ReadRune() will return io.EOF as an error when the EOF is reached
+// This method will also keep track of the current linenumber and column in
+// the buffer and the rune offset in the buffer
+func (s *Scanner) next() ([]rune, error)  {
+  if err := s.fill(s.offset + 1); err != nil {
+    return []rune{rune(0)}, err
+  }
+  if s.offset >= s.end() {
     // io.EOF is an error however, but we need a rune
     return []rune{EOF}, io.EOF
   }
+  ch := s.runes[s.offset - s.base]
   if ch == '\n' {
     s.lineno++
+    s.column = 1
+  } else {
+    s.column++
   }
   s.offset++  // move the read pointer
   return []rune{ch}, nil
@@ -60,80 +171,71 @@ func (s *scanner) next() ([]rune, error)  {
 // peek will return a rune slice for the next N runes
 // we can't peek less than 0 runes, that will throw io.EOF
 // if we peek past the EOF we'll return the runes upto EOF and return io.EOF
-func (s *scanner) peek(count int) ([]rune, error) {
-  offset := s.offset
-  var runes []rune
-
+// the runes are not copied so they must not be modified
+func (s *Scanner) peek(count int) ([]rune, error) {
   if count < 1 {
     return nil, io.EOF
   }
-
-  for i := 1; i <= count; i++ {
-    ch, _, err := s.reader.ReadRune()
-    if err != nil {
-      if err := s.seek(offset); err != nil {
-        panic("can't unroll peek")
-      }
-      if err == io.EOF {
-        // if we scan past the EOF return runes up to the EOF
-        // this allows for less complex peek/peek logic elsewhere
-        return runes, err
-      } else {
-        return nil, err
-      }
-    }
-    runes = append(runes, ch)
-  }
-  // unroll - can use unreadrune because it requires having called readrune
-  // as the previous call
-  if err := s.seek(offset); err != nil {
-    panic("can't unroll peek")
+  if err := s.fill(s.offset + int64(count)); err != nil {
+    return nil, err
   }
 
-  return runes, nil
+  start := s.offset - s.base
+  end := start + int64(count)
+  if end > int64(len(s.runes)) {
+    // if we scan past the EOF return runes up to the EOF
+    // this allows for less complex peek/peek logic elsewhere
+    end = int64(len(s.runes))
+    return s.runes[start:end:end], io.EOF
+  }
+  // cap the slice so appending to it can't overwrite the buffer
+  return s.runes[start:end:end], nil
 }
 
 // the 'offset' is in runes no bytes, this is because we want to
 // get the lineno
 // if you attempt to seek past the end of file, we'll just fast forward to EOF
 // and then exit
-func (s *scanner) seek(offset int64) (error) {
-  oldoffset := s.offset
-  oldlineno := s.lineno
-
+// seeking doesn't rescan anything already read, the line is looked up in the
+// line index which is quick for seeks within the current line
+// seeking back to runes that have been discarded errors
+func (s *Scanner) seek(offset int64) (error) {
   // fast fail on negative seeks
   if offset < 0 {
     return io.EOF
   }
-  // reset the buffer pointer to the start
-  _, err := s.reader.Seek(0, io.SeekStart)
-  if err != nil {
+  if offset < s.base {
+    return fmt.Errorf("can't seek to offset %d, the scanner has discarded everything before %d", offset, s.base)
+  }
+  if err := s.fill(offset); err != nil {
     return err
   }
-  s.offset = int64(0)
-  s.lineno = 1
+  if offset > s.end() {
+    // we've seeked past the EOF
+    offset = s.end()
+  }
 
-  // now run next() for each offset
-  for i := int64(0); i < offset; i++ {
-    _, err := s.next()
-    //log.Println(string(runes))
-    // if we hit an error running next() we'll revert to the pre-seek position
-    // and return the error
-    if err != nil {
-      if err == io.EOF {
-        // we've seeked to or past the EOF
-        return nil
-      }
-      s.offset = oldoffset
-      s.lineno = oldlineno
-      return err
-    }
+  line := s.lineno - 1 - s.first
+  if !s.onLine(line, offset) {
+    // find the last line starting at or before the offset
+    line = sort.Search(len(s.lines), func(i int) bool { return s.lines[i] > offset }) - 1
   }
+  s.offset = offset
+  s.lineno = s.first + line + 1
+  s.column = int(offset - s.lines[line]) + 1
   return nil
 }
 
+// test if an offset is on a line, lines are indexed from the first line kept
+func (s *Scanner) onLine(line int, offset int64) bool {
+  if line < 0 || line >= len(s.lines) || offset < s.lines[line] {
+    return false
+  }
+  return line + 1 == len(s.lines) || offset < s.lines[line + 1]
+}
+
 // test for start of whitespace
-func (s *scanner) isWhitespace(runes []rune) bool {
+func (s *Scanner) isWhitespace(runes []rune) bool {
   if len(runes) >= 1 {
     return runes[0] == ' ' || runes[0] == '\t' || runes[0] == '\n' || runes[0] == '\r'
   }
@@ -142,16 +244,18 @@ func (s *scanner) isWhitespace(runes []rune) bool {
 
 // consumes whitespace at the current scanner offset
 // attempting to consume whitespace from a non-whitespace rune errors
-func (s *scanner) scanForWhitespace() (*token, error) {
+func (s *Scanner) scanForWhitespace() (*Token, error) {
   var rs []rune
   offset := s.offset
   lineno := s.lineno
+  column := s.column
 
   // back out if we are scanning starting from non whitespace
   runes, err := s.peek(1)
   if err != nil && err != io.EOF {
     s.offset = offset
     s.lineno = lineno
+    s.column = column
     return nil, err
   }
 
@@ -167,6 +271,7 @@ func (s *scanner) scanForWhitespace() (*token, error) {
       }
       s.offset = offset
       s.lineno = lineno
+      s.column = column
       return nil, err
     }
 
@@ -175,15 +280,16 @@ func (s *scanner) scanForWhitespace() (*token, error) {
     if err != nil && err != io.EOF {
       s.offset = offset
       s.lineno = lineno
+      s.column = column
       return nil, err
     }
   }
-  return &token{runes:rs, ttype:WHITESPACE, offset:offset, lineno:lineno}, nil
+  return &Token{runes:rs, ttype:WHITESPACE, offset:offset, lineno:lineno, column:column}, nil
 }
 
 // for our purposes, anything that isn't whitspace should be collapsed
 // this allows us to reconstruct things with whitespace in the parser
-func (s *scanner) isIdent(runes []rune) bool {
+func (s *Scanner) isIdent(runes []rune) bool {
   if len(runes) >= 1 {
     return !s.isWhitespace(runes) && runes[0] != EOF
   }
@@ -192,19 +298,21 @@ func (s *scanner) isIdent(runes []rune) bool {
 
 // consumes ident runes at the current scanner offset
 // attempting to consume an ident from a non-ident rune errors
-func (s *scanner) scanForIdent() (*token, error) {
+func (s *Scanner) scanForIdent() (*Token, error) {
   var rs []rune
   offset := s.offset
   lineno := s.lineno
+  column := s.column
 
   // back out if we are scanning starting from non whitespace
   runes, err := s.peek(2)
   if err != nil && err != io.EOF {
     s.offset = offset
     s.lineno = lineno
+    s.column = column
     return nil, err
   }
-  for s.isIdent(runes) && !s.isComment(runes) {
+  for s.isIdent(runes) && !s.isComment(runes) && !s.quoteAfter(rs, runes) {
     // we can now start pulling the whitespace runes
     consumed, err := s.next()
     // if we get an error we reset the offset and back out
@@ -216,6 +324,7 @@ func (s *scanner) scanForIdent() (*token, error) {
       }
       s.offset = offset
       s.lineno = lineno
+      s.column = column
       return nil, err
     }
 
@@ -224,14 +333,143 @@ func (s *scanner) scanForIdent() (*token, error) {
     if err != nil && err != io.EOF {
       s.offset = offset
       s.lineno = lineno
+      s.column = column
       return nil, err
     }
   }
-  return &token{runes:rs, ttype:IDENT, offset:offset, lineno:lineno}, nil
+  return &Token{runes:rs, ttype:IDENT, offset:offset, lineno:lineno, column:column}, nil
+}
+
+// test for the start of a string, quoted identifier or dollar quoted body
+func (s *Scanner) isQuote(runes []rune) bool {
+  if len(runes) >= 1 {
+    if runes[0] == '\'' || runes[0] == '"' || runes[0] == '`' {
+      return true
+    }
+    return runes[0] == '$' && s.dollarTag() != nil
+  }
+  return false
+}
+
+// test for a quote starting after the ident runes consumed so far
+// a $ in the middle of a name (v$session) doesn't start a dollar quote
+func (s *Scanner) quoteAfter(consumed []rune, runes []rune) bool {
+  if len(runes) >= 1 && runes[0] == '$' && len(consumed) > 0 && isNameRune(consumed[len(consumed) - 1]) {
+    return false
+  }
+  return s.isQuote(runes)
+}
+
+// test for a rune that can be part of an unquoted name
+func isNameRune(r rune) bool {
+  return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$'
+}
+
+// returns the $tag$ at the current offset, nil if there isn't one
+// tags are empty or a name that doesn't start with a digit, so $1 isn't one
+func (s *Scanner) dollarTag() []rune {
+  for n := 2; ; n++ {
+    runes, _ := s.peek(n)
+    if len(runes) < n || runes[0] != '$' {
+      return nil
+    }
+    r := runes[n - 1]
+    if r == '$' {
+      return runes
+    }
+    if !isNameRune(r) || n == 2 && unicode.IsDigit(r) {
+      return nil
+    }
+  }
+}
+
+// consumes a quoted token at the current scanner offset
+// comments and whitespace inside the quotes are part of the token, a quote
+// is escaped by doubling it ('it''s'), or with a backslash ('it\'s') when
+// SetBackslashEscapes is on, dollar quoted bodies have no escapes
+// attempting to consume a quote from a non-quote rune errors
+func (s *Scanner) scanForQuote() (*Token, error) {
+  offset := s.offset
+  lineno := s.lineno
+  column := s.column
+
+  runes, err := s.peek(1)
+  if err != nil && err != io.EOF {
+    return nil, err
+  }
+  var ttype int
+  var closing []rune
+  var what string
+  switch {
+  case len(runes) < 1:
+  case runes[0] == '\'':
+    ttype, closing, what = STRING, []rune{'\''}, "string"
+  case runes[0] == '"':
+    ttype, closing, what = QUOTEDIDENT, []rune{'"'}, "quoted identifier"
+  case runes[0] == '`':
+    ttype, closing, what = BACKTICKIDENT, []rune{'`'}, "quoted identifier"
+  case runes[0] == '$':
+    closing, what = s.dollarTag(), "dollar quoted string"
+    ttype = DOLLARQUOTED
+  }
+  if closing == nil {
+    return nil, &ParseError{Line: lineno, Column: column, Msg: "expected a quote"}
+  }
+
+  // consume the opening quote
+  rs := make([]rune, 0, len(closing) + 1)
+  for range(closing) {
+    consumed, _ := s.next()
+    rs = append(rs, consumed...)
+  }
+  for {
+    runes, err := s.peek(len(closing))
+    if err != nil && err != io.EOF {
+      s.offset = offset
+      s.lineno = lineno
+      s.column = column
+      return nil, err
+    }
+    if len(runes) < len(closing) {
+      s.offset = offset
+      s.lineno = lineno
+      s.column = column
+      return nil, &ParseError{Line: lineno, Column: column, Msg: "unterminated " + what}
+    }
+    // a backslash escapes whatever follows it, including the quote
+    if s.backslash && runes[0] == '\\' && (ttype == STRING || ttype == QUOTEDIDENT) {
+      consumed, _ := s.next()
+      rs = append(rs, consumed...)
+      if next, _ := s.peek(1); len(next) < 1 {
+        continue
+      }
+    } else if string(runes) == string(closing) {
+      for range(closing) {
+        consumed, _ := s.next()
+        rs = append(rs, consumed...)
+      }
+      if ttype == DOLLARQUOTED {
+        break
+      }
+      // a doubled quote is an escaped quote
+      if next, _ := s.peek(1); len(next) < 1 || next[0] != closing[0] {
+        break
+      }
+    }
+    consumed, err := s.next()
+    if err != nil {
+      s.offset = offset
+      s.lineno = lineno
+      s.column = column
+      return nil, err
+    }
+    rs = append(rs, consumed...)
+  }
+  return &Token{runes:rs, ttype:ttype, offset:offset, lineno:lineno, column:column}, nil
 }
 
 // test for comments staring with '//' and '/*' and '--'
-func (s *scanner) isComment(runes []rune) bool {
+func (s *Scanner) isComment(runes []rune) bool {
   if len(runes) >= 2 {
     if runes[0] == '/' && runes[1] == '/' ||
        runes[0] == '/' && runes[1] == '*' ||
@@ -244,16 +482,18 @@ func (s *scanner) isComment(runes []rune) bool {
 
 // consumes comments at the current scanner offset
 // attempting to consume a comment from a non-comment rune errors
-func (s *scanner) scanForComment() (*token, error) {
+func (s *Scanner) scanForComment() (*Token, error) {
   var rs []rune
   offset := s.offset
   lineno := s.lineno
+  column := s.column
 
   // peek 2 runes
   runes, err := s.peek(2)
   if err != nil && err != io.EOF {
     s.offset = offset
     s.lineno = lineno
+    s.column = column
     return nil, err
   }
 
@@ -271,6 +511,7 @@ func (s *scanner) scanForComment() (*token, error) {
         }
         s.offset = offset
         s.lineno = lineno
+        s.column = column
         return nil, err
       }
 
@@ -279,6 +520,7 @@ func (s *scanner) scanForComment() (*token, error) {
       if err != nil && err != io.EOF {
         s.offset = offset
         s.lineno = lineno
+        s.column = column
         return nil, err
       }
     }
@@ -295,6 +537,7 @@ func (s *scanner) scanForComment() (*token, error) {
         }
         s.offset = offset
         s.lineno = lineno
+        s.column = column
         return nil, err
       }
 
@@ -303,47 +546,52 @@ func (s *scanner) scanForComment() (*token, error) {
       if err != nil && err != io.EOF {
         s.offset = offset
         s.lineno = lineno
+        s.column = column
         return nil, err
       }
     }
   //consume a java style comment
+  // with nested comments on each /* needs its own */
   } else if (runes[0] == '/' && runes[1] == '*') {
-    // we exit if we peek EOF, err or the last 2 consumed runes are */
-    for len(runes) > 0 && runes[0] != EOF {
-      // exit this if we have consumed */ previously
-      if len(rs) > 1 {
-        if rs[len(rs)-2] == '*' && rs[len(rs)-1] == '/' {
-          break
-        }
-      }
-      consumed, err := s.next()
-      // if we get an error we reset the offset and back out
-      if err != nil {
-        if err == io.EOF {
-          // we shouldn't get here, but if we do read EOF off of next() we'll
-          // just break and return the rs
-          break
-        }
+    depth := 0
+    for {
+      runes, err = s.peek(2)
+      if err != nil && err != io.EOF {
         s.offset = offset
         s.lineno = lineno
+        s.column = column
         return nil, err
       }
-
-      rs = append(rs, consumed...)
-      runes, err = s.peek(1)
-      if err != nil && err != io.EOF {
+      // we've hit EOF without closing the comment
+      if len(runes) < 1 {
         s.offset = offset
         s.lineno = lineno
-        return nil, err
+        s.column = column
+        return nil, &ParseError{Line: lineno, Column: column, Msg: "unterminated comment"}
+      }
+      count := 1
+      if len(runes) == 2 && runes[0] == '/' && runes[1] == '*' && (depth == 0 || s.nested) {
+        depth++
+        count = 2
+      } else if len(runes) == 2 && runes[0] == '*' && runes[1] == '/' {
+        depth--
+        count = 2
+      }
+      for i := 0; i < count; i++ {
+        consumed, _ := s.next()
+        rs = append(rs, consumed...)
+      }
+      if depth == 0 {
+        break
       }
     }
   }
-  return &token{runes:rs, ttype:COMMENT, offset:offset, lineno:lineno}, nil
+  return &Token{runes:rs, ttype:COMMENT, offset:offset, lineno:lineno, column:column}, nil
 }
 
 // simple non-errorable test for has more tokens
 // errors are interpreted as false - no token for you :(
-func (s *scanner) HasMoreTokens() (bool) {
+func (s *Scanner) HasMoreTokens() (bool) {
   runes, err := s.peek(1)
   if err != nil && len(runes) < 1 {
     return false
@@ -351,7 +599,29 @@ func (s *scanner) HasMoreTokens() (bool) {
   return true
 }
 
-func (s *scanner) NextToken() (*token, error) {
+// yield WHITESPACE and COMMENT tokens from NextToken rather than skipping them
+// with trivia on the runes of every token put together are the revision as it
+// was written, as long as it's valid utf-8
+func (s *Scanner) SetTrivia(trivia bool) {
+  s.trivia = trivia
+}
+
+// let /* */ comments nest, as they do in postgres
+// otherwise a comment ends at the first */
+func (s *Scanner) SetNestedComments(nested bool) {
+  s.nested = nested
+}
+
+// let a backslash escape the rune after it in '' and "" quotes, as it does in
+// mysql, otherwise quotes are only escaped by doubling them
+func (s *Scanner) SetBackslashEscapes(backslash bool) {
+  s.backslash = backslash
+}
+
+// returns the next IDENT or quoted token, comments and whitespace are skipped
+// unless SetTrivia is on
+// io.EOF is returned once there are no more tokens
+func (s *Scanner) NextToken() (*Token, error) {
   var runes []rune
   runes, err := s.peek(2)
   // we can run into EOF if only 1 character is left
@@ -361,20 +631,23 @@ func (s *scanner) NextToken() (*token, error) {
   // at this point runes can contain either 1 or 2 runes
   if s.isWhitespace(runes) {
     // skip whitespace
-    _, err := s.scanForWhitespace()
-    if err != nil {
-      return nil, err
+    ws, err := s.scanForWhitespace()
+    if err != nil || s.trivia {
+      return ws, err
     }
     return s.NextToken()
   }
   if s.isComment(runes) {
     // skip comments
-    _, err :=s.scanForComment()
-    if err != nil {
-      return nil, err
+    comment, err := s.scanForComment()
+    if err != nil || s.trivia {
+      return comment, err
     }
     return s.NextToken()
   }
+  if s.isQuote(runes) {
+    return s.scanForQuote()
+  }
   if s.isIdent(runes) {
     ident, err := s.scanForIdent()
     if err != nil {
@@ -382,5 +655,5 @@ func (s *scanner) NextToken() (*token, error) {
     }
     return ident, nil
   }
-  return nil, errors.New("Unknown token type")
+  return nil, &ParseError{Line: s.lineno, Column: s.column, Msg: "unknown token type"}
 }
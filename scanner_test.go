@@ -2,7 +2,10 @@ package drift
 
 import (
   "testing"
+  "bytes"
   "io"
+  "fmt"
+  "strings"
 )
 
 func TestCreateScanner(t *testing.T) {
@@ -14,7 +17,7 @@ func TestCreateScanner(t *testing.T) {
   if s.lineno != 1 {
     t.Errorf("lineno: expected %v got %v", 1, s.lineno)
   }
-  rs := s.reader.Size()
+  rs := s.reader.(*bytes.Reader).Size()
   bs := int64(len([]byte(data)))
   if rs != bs {
     t.Errorf("reader.size: expected %v got %v", bs, rs)
@@ -56,6 +59,22 @@ func TestNextLineno(t *testing.T) {
   }
 }
 
+func TestNextColumn(t *testing.T) {
+  data := "ab\n风c"
+  s := NewScanner([]byte(data))
+  for _, expected := range([]int{2, 3, 1, 2, 3}) {
+    s.next()
+    if s.column != expected {
+      t.Errorf("expected column to be %v got %v", expected, s.column)
+    }
+  }
+  // seeking recomputes the column
+  s.seek(4)
+  if s.column != 2 {
+    t.Errorf("expected column to be %v got %v", 2, s.column)
+  }
+}
+
 func TestNextEOF(t *testing.T) {
   data := `风`
   s := NewScanner([]byte(data))
@@ -355,7 +374,7 @@ func TestScanIdent(t *testing.T) {
     0:{"a", 0, 1},
     2:{"bcd", 2, 1},
     6:{"1.2E+10", 6, 1},
-    25:{"!@#$%^&*()_+{}:\"<>?,./;'[]\\'\"", 25, 1},
+    25:{"!@#$%^&*()_+{}:", 25, 1},   // stops at the quoted identifier
     61:{"z", 61, 1},
     68:{"役立てることができることからきている" ,68, 3},
   }) {
@@ -379,6 +398,70 @@ func TestScanIdent(t *testing.T) {
   }
 }
 
+func TestScanQuote(t *testing.T) {
+  for _, value := range([]struct{
+    data  string
+    value string
+    ttype int
+  }{
+    {`'--not a comment' x`, `'--not a comment'`, STRING},
+    {`'it''s' x`, `'it''s'`, STRING},
+    {`'/*%'`, `'/*%'`, STRING},
+    {`'' x`, `''`, STRING},
+    {`"http://host" x`, `"http://host"`, QUOTEDIDENT},
+    {`"<>?,./;'[]\'" x`, `"<>?,./;'[]\'"`, QUOTEDIDENT},
+    {"`my -- col` x", "`my -- col`", BACKTICKIDENT},
+    {"$$ SELECT 'a'; -- b\n $$ x", "$$ SELECT 'a'; -- b\n $$", DOLLARQUOTED},
+    {"$fn$ $$ $f$ $fn$ x", "$fn$ $$ $f$ $fn$", DOLLARQUOTED},
+  }) {
+    s := NewScanner([]byte(value.data))
+    tok, err := s.NextToken()
+    if err != nil {
+      t.Errorf("%v: unexpected error %v", value.data, err)
+      continue
+    }
+    if string(tok.runes) != value.value || tok.ttype != value.ttype {
+      t.Errorf("expected %v (%v) got %v (%v)", value.value, value.ttype, string(tok.runes), tok.ttype)
+    }
+  }
+}
+
+// quotes split idents but $ only starts a dollar quote outside of a name
+func TestScanQuoteInIdent(t *testing.T) {
+  data := `x='a b' v$session $1 f($$--x$$) name"q"`
+  s := NewScanner([]byte(data))
+  var tokens []string
+  for {
+    tok, err := s.NextToken()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      t.Fatalf("unexpected error %v", err)
+    }
+    tokens = append(tokens, string(tok.runes))
+  }
+  expected := []string{`x=`, `'a b'`, `v$session`, `$1`, `f(`, `$$--x$$`, `)`, `name`, `"q"`}
+  if strings.Join(tokens, "|") != strings.Join(expected, "|") {
+    t.Errorf("expected %v got %v", expected, tokens)
+  }
+}
+
+func TestScanQuoteUnterminated(t *testing.T) {
+  for _, data := range([]string{`'abc`, `"abc''`, "`abc", "$a$ abc $b$", `'it''`}) {
+    s := NewScanner([]byte("x " + data))
+    s.seek(2)
+    _, err := s.scanForQuote()
+    perr, ok := err.(*ParseError)
+    if !ok || perr.Line != 1 || perr.Column != 3 || !strings.HasPrefix(perr.Msg, "unterminated") {
+      t.Errorf("%v: expected an unterminated error at 1:3 got %v", data, err)
+    }
+    if s.offset != 2 {
+      t.Errorf("expected offset %v got %v", 2, s.offset)
+    }
+  }
+}
+
 func TestScanIdentBadStart(t *testing.T) {
   data := `a bcd 1.2E+10            !@#$%^&*()_+{}:"<>?,./;'[]\'"       z
 
@@ -551,35 +634,101 @@ func TestScanJavaCommentEOF(t *testing.T) {
   }
 }
 
+// an unterminated comment errors where it started rather than swallowing the
+// rest of the revision
 func TestScanJavaCommentUnterminated(t *testing.T) {
-  data := `/*comment`
-  s := NewScanner([]byte(data))
-  comment, err := s.scanForComment()
-  value := "/*comment"
-  if err != nil {
-    t.Errorf("unexpected error %v", err)
+  for _, value := range([]struct{
+    data   string
+    lineno int
+    column int
+  }{
+    {`/*comment`, 1, 1},
+    {`/*/`, 1, 1},
+    {"x\n  /* a */ /* b\n*", 2, 11},
+  }) {
+    s := NewScanner([]byte(value.data))
+    var err error
+    for err == nil {
+      _, err = s.NextToken()
+    }
+    perr, ok := err.(*ParseError)
+    if !ok || perr.Msg != "unterminated comment" {
+      t.Errorf("%q: expected an unterminated comment got %v", value.data, err)
+      continue
+    }
+    if perr.Line != value.lineno || perr.Column != value.column {
+      t.Errorf("%q: expected %v:%v got %v:%v", value.data, value.lineno, value.column, perr.Line, perr.Column)
+    }
   }
-  if string(comment.runes) != value {
-    t.Errorf("expected %v got %v", value, string(comment.runes))
+}
+
+func TestScanJavaCommentNested(t *testing.T) {
+  data := `/* a /* b */ c */ d`
+  for _, value := range([]struct{
+    nested  bool
+    comment string
+  }{
+    {false, `/* a /* b */`},
+    {true, `/* a /* b */ c */`},
+  }) {
+    s := NewScanner([]byte(data))
+    s.SetNestedComments(value.nested)
+    comment, err := s.scanForComment()
+    if err != nil {
+      t.Errorf("unexpected error %v", err)
+      continue
+    }
+    if string(comment.runes) != value.comment {
+      t.Errorf("nested %v: expected %v got %v", value.nested, value.comment, string(comment.runes))
+    }
   }
-  if comment.ttype != COMMENT {
-    t.Errorf("expected %v got %v", COMMENT, comment.ttype)
+
+  s := NewScanner([]byte(`/* a /* b */ d`))
+  s.SetNestedComments(true)
+  if _, err := s.scanForComment(); err == nil || s.offset != 0 {
+    t.Errorf("expected an unterminated comment got %v at %v", err, s.offset)
   }
-  if comment.offset != 0 {
-    t.Errorf("expected %v got %v", 0, comment.offset)
+}
+
+func TestScanBackslashEscapes(t *testing.T) {
+  for _, value := range([]struct{
+    data      string
+    backslash bool
+    expected  string
+  }{
+    {`'it\'s' x`, true, `'it\'s'`},
+    {`'a\\' x`, true, `'a\\'`},
+    {`"a\"b" x`, true, `"a\"b"`},
+    {`'it''s' x`, true, `'it''s'`},
+    {`'a\' x`, false, `'a\'`},
+    {"`a\\` x", true, "`a\\`"},
+  }) {
+    s := NewScanner([]byte(value.data))
+    s.SetBackslashEscapes(value.backslash)
+    tok, err := s.scanForQuote()
+    if err != nil {
+      t.Errorf("%v: unexpected error %v", value.data, err)
+      continue
+    }
+    if string(tok.runes) != value.expected {
+      t.Errorf("backslash %v: expected %v got %v", value.backslash, value.expected, string(tok.runes))
+    }
   }
-  if comment.lineno != 1 {
-    t.Errorf("expected %v got %v", 1, comment.lineno)
+
+  s := NewScanner([]byte(`'it\'s`))
+  s.SetBackslashEscapes(true)
+  if _, err := s.scanForQuote(); err == nil || s.offset != 0 {
+    t.Errorf("expected an unterminated string got %v at %v", err, s.offset)
   }
 }
 
 func TestNextToken(t *testing.T) {
   data := `a b c`
   s := NewScanner([]byte(data))
-  for _, value := range([]token {
-    token{runes:[]rune{'a'}, ttype:IDENT, offset:0, lineno:1},
-    token{runes:[]rune{'b'}, ttype:IDENT, offset:2, lineno:1},
-    token{runes:[]rune{'c'}, ttype:IDENT, offset:4, lineno:1},
+  for _, value := range([]Token {
+    Token{runes:[]rune{'a'}, ttype:IDENT, offset:0, lineno:1},
+    Token{runes:[]rune{'b'}, ttype:IDENT, offset:2, lineno:1},
+    Token{runes:[]rune{'c'}, ttype:IDENT, offset:4, lineno:1},
   }) {
     token, err := s.NextToken()
     if err != nil {
@@ -624,12 +773,12 @@ func TestNextTokenMoreComplex(t *testing.T) {
   end*/
   -/`
   s := NewScanner([]byte(data))
-  for _, value := range([]token {
-    token{runes:[]rune("-"), ttype:IDENT, offset:0, lineno:1},
-    token{runes:[]rune("CREATE"), ttype:IDENT, offset:101, lineno:6},
-    token{runes:[]rune("TABLE"), ttype:IDENT, offset:108, lineno:6},
-    token{runes:[]rune("exercise_logs;"), ttype:IDENT, offset:114, lineno:6},
-    token{runes:[]rune("-/"), ttype:IDENT, offset:144, lineno:9},
+  for _, value := range([]Token {
+    Token{runes:[]rune("-"), ttype:IDENT, offset:0, lineno:1},
+    Token{runes:[]rune("CREATE"), ttype:IDENT, offset:101, lineno:6},
+    Token{runes:[]rune("TABLE"), ttype:IDENT, offset:108, lineno:6},
+    Token{runes:[]rune("exercise_logs;"), ttype:IDENT, offset:114, lineno:6},
+    Token{runes:[]rune("-/"), ttype:IDENT, offset:144, lineno:9},
   }) {
     token, err := s.NextToken()
     if err != nil {
@@ -649,3 +798,133 @@ func TestNextTokenMoreComplex(t *testing.T) {
     }
   }
 }
+
+// seeking back and forth keeps the lineno and column in step with next()
+func TestSeekBackAndForth(t *testing.T) {
+  data := "ab\n风c\n\nd"
+  s := NewScanner([]byte(data))
+  var positions [][2]int
+  for {
+    positions = append(positions, [2]int{s.lineno, s.column})
+    if _, err := s.next(); err != nil {
+      break
+    }
+  }
+  for _, offset := range([]int64{8, 0, 5, 4, 3, 7, 2, 6, 1, 8, 3}) {
+    if err := s.seek(offset); err != nil {
+      t.Errorf("seek: unexpected error %v", err)
+    }
+    expected := positions[offset]
+    if s.offset != offset || s.lineno != expected[0] || s.column != expected[1] {
+      t.Errorf("seek %v: expected %v:%v got %v:%v at %v", offset, expected[0], expected[1], s.lineno, s.column, s.offset)
+    }
+  }
+}
+
+// peeking doesn't move the scanner and runes are only decoded once
+func TestPeekDoesNotRescan(t *testing.T) {
+  data := "hello\nworld"
+  s := NewScanner([]byte(data))
+  s.seek(7)
+  runes, err := s.peek(2)
+  if err != nil || string(runes) != "or" {
+    t.Errorf("peek: expected %v got %v %v", "or", string(runes), err)
+  }
+  if s.offset != 7 || s.lineno != 2 || s.column != 2 {
+    t.Errorf("peek: expected to stay at 7 (2:2) got %v (%v:%v)", s.offset, s.lineno, s.column)
+  }
+  // appending to peeked runes can't change what's scanned next
+  runes = append(runes, 'X')
+  runes, _ = s.peek(3)
+  if string(runes) != "orl" {
+    t.Errorf("peek: expected %v got %v", "orl", string(runes))
+  }
+  if len(s.runes) != 10 || s.reader.(*bytes.Reader).Len() != 1 {
+    t.Errorf("expected %v runes decoded got %v", 10, len(s.runes))
+  }
+}
+
+// with trivia on every token is returned and they add back up to the data
+func TestNextTokenTrivia(t *testing.T) {
+  data := "-- header\r\nSELECT  'a -- b' /* c */, \"风\"\n\t// done\n"
+  s := NewScanner([]byte(data))
+  s.SetTrivia(true)
+  var all []rune
+  var types []int
+  for {
+    tok, err := s.NextToken()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      t.Fatalf("unexpected error %v", err)
+    }
+    all = append(all, tok.runes...)
+    types = append(types, tok.ttype)
+  }
+  if string(all) != data {
+    t.Errorf("expected %q got %q", data, string(all))
+  }
+  expected := []int{COMMENT, WHITESPACE, IDENT, WHITESPACE, STRING, WHITESPACE, COMMENT,
+    IDENT, WHITESPACE, QUOTEDIDENT, WHITESPACE, COMMENT, WHITESPACE}
+  if fmt.Sprint(types) != fmt.Sprint(expected) {
+    t.Errorf("expected %v got %v", expected, types)
+  }
+}
+
+// streamed runes are discarded a line at a time without losing our place
+func TestScannerDiscard(t *testing.T) {
+  line := strings.Repeat("x", 99) + "\n"
+  data := strings.Repeat(line, 1000)
+  s := NewReaderScanner(strings.NewReader(data))
+  count := 0
+  for s.HasMoreTokens() {
+    tok, err := s.NextToken()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      t.Fatalf("unexpected error %v", err)
+    }
+    count++
+    if tok.lineno != count || tok.column != 1 || tok.offset != int64((count - 1) * 100) {
+      t.Fatalf("expected token at %v:1 got %v:%v", count, tok.lineno, tok.column)
+    }
+    if s.line(count) != line[:99] {
+      t.Fatalf("expected line %v got '%v'", count, s.line(count))
+    }
+    s.discard()
+    if len(s.runes) > discardSize + 100 {
+      t.Fatalf("expected at most %v runes held got %v", discardSize + 100, len(s.runes))
+    }
+  }
+  if count != 1000 {
+    t.Errorf("expected %v tokens got %v", 1000, count)
+  }
+  // discarded runes are gone for good
+  if s.base == 0 || s.seek(0) == nil || len(s.line(1)) != 0 {
+    t.Errorf("expected the start of the data to be discarded")
+  }
+  if err := s.seek(s.base); err != nil || s.lineno != s.first + 1 || s.column != 1 {
+    t.Errorf("expected to seek to %v:1 got %v:%v %v", s.first + 1, s.lineno, s.column, err)
+  }
+}
+
+func BenchmarkNextToken(b *testing.B) {
+  var buf bytes.Buffer
+  buf.WriteString("--+ changeset id:seed\n")
+  for i := 0; i < 20000; i++ {
+    buf.WriteString("INSERT INTO t VALUES (1, 'two', 3.0); -- seed data\n")
+  }
+  data := buf.Bytes()
+  b.SetBytes(int64(len(data)))
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    s := NewScanner(data)
+    for s.HasMoreTokens() {
+      if _, err := s.NextToken(); err != nil {
+        break
+      }
+    }
+  }
+}
@@ -0,0 +1,132 @@
+package drift
+
+import (
+  "io"
+  "fmt"
+  "strings"
+  "unicode"
+)
+
+// the delimiter statements are split on unless a changeset says otherwise
+const DefaultDelimiter = ";"
+
+// A StatementError is a statement of a changeset that failed to run
+type StatementError struct {
+  Index     int      // position of the statement in the changeset, from 1
+  Statement string
+  Err       error
+}
+
+func (e *StatementError) Error() string {
+  return fmt.Sprintf("statement %d (%s): %v", e.Index, summarize(e.Statement), e.Err)
+}
+
+func (e *StatementError) Unwrap() error { return e.Err }
+
+// the first line of a statement, shortened for error messages
+func summarize(statement string) string {
+  line := strings.SplitN(statement, "\n", 2)[0]
+  if runes := []rune(line); len(runes) > 60 {
+    line = string(runes[:57]) + "..."
+  } else if line != statement {
+    line += " ..."
+  }
+  return line
+}
+
+// splits sql in to statements on the delimiter
+// delimiters inside strings, quoted identifiers and comments don't count and
+// statements that are only comments are dropped
+// the standard ; delimiter is kept on the end of each statement since it's
+// part of the sql, custom delimiters (// or $$) are removed
+// nested says whether block comments nest, see Scanner.SetNestedComments, and
+// backslash whether a backslash escapes quotes, see Scanner.SetBackslashEscapes
+// sql the scanner can't make sense of is returned as a single statement
+func splitStatements(sql string, delimiter string, nested bool, backslash bool) []string {
+  if len(delimiter) == 0 {
+    delimiter = DefaultDelimiter
+  }
+  var statements []string
+  var current []rune
+  code := false   // the current statement has more than comments in it
+  // closes out the current statement, delimited is false at the end of the sql
+  end := func(delimited bool) {
+    if delimited && delimiter == DefaultDelimiter {
+      current = append(current, []rune(delimiter)...)
+    }
+    if code {
+      statements = append(statements, strings.TrimSpace(string(current)))
+    }
+    current = nil
+    code = false
+  }
+
+  s := NewScanner([]byte(sql))
+  s.SetTrivia(true)
+  s.SetNestedComments(nested)
+  s.SetBackslashEscapes(backslash)
+  d := []rune(delimiter)
+  for {
+    // a delimiter that looks like the start of a comment or a dollar quote
+    // (// or $$) still ends the statement
+    if delimiterAt(s, d) {
+      s.seek(s.offset + int64(len(d)))
+      end(true)
+      continue
+    }
+    tok, err := s.NextToken()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return []string{strings.TrimSpace(sql)}
+    }
+    if tok.ttype != IDENT || isWordDelimiter(d) {
+      current = append(current, tok.runes...)
+      code = code || tok.ttype != WHITESPACE && tok.ttype != COMMENT
+      continue
+    }
+    // idents run up to whitespace so can hold delimiters: 1);INSERT
+    parts := strings.Split(string(tok.runes), delimiter)
+    for i, part := range(parts) {
+      if i > 0 {
+        end(true)
+      }
+      current = append(current, []rune(part)...)
+      code = code || len(part) > 0
+    }
+  }
+  end(false)
+  return statements
+}
+
+// whether a rune can be part of a word, see isWordDelimiter
+func isWordRune(r rune) bool {
+  return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// whether the delimiter starts or ends like a word (GO), rather than being
+// punctuation (// or $$)
+func isWordDelimiter(delimiter []rune) bool {
+  return len(delimiter) > 0 && (isWordRune(delimiter[0]) || isWordRune(delimiter[len(delimiter) - 1]))
+}
+
+// whether the delimiter is at the scanner's offset
+// a word like delimiter only matches as a whole word, so GO ends a statement
+// but GOTO and CATEGORY don't
+func delimiterAt(s *Scanner, delimiter []rune) bool {
+  n := len(delimiter)
+  runes, _ := s.peek(n + 1)
+  if n == 0 || len(runes) < n || string(runes[:n]) != string(delimiter) {
+    return false
+  }
+  if isWordRune(delimiter[n - 1]) && len(runes) > n && isWordRune(runes[n]) {
+    return false
+  }
+  // runes before the current line may have been discarded, but then the rune
+  // before the delimiter is a newline
+  if isWordRune(delimiter[0]) && s.offset > s.base && isWordRune(s.runes[s.offset - s.base - 1]) {
+    return false
+  }
+  return true
+}
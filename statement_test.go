@@ -0,0 +1,50 @@
+package drift
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+  for _, value := range([]struct{
+    sql        string
+    delimiter  string
+    statements []string
+  }{
+    {"SELECT 1;", ";", []string{"SELECT 1;"}},
+    {"SELECT 1", ";", []string{"SELECT 1"}},
+    {"SELECT 1; SELECT 2", ";", []string{"SELECT 1;", "SELECT 2"}},
+    {"SELECT 1;SELECT 2;;", ";", []string{"SELECT 1;", "SELECT 2;"}},
+    {"SELECT ';', \"a;b\", `c;d` /* ; */ -- ;\n;", ";", []string{"SELECT ';', \"a;b\", `c;d` /* ; */ -- ;\n;"}},
+    {"CREATE FUNCTION f() AS $$ BEGIN; END; $$;\nSELECT f();", ";",
+      []string{"CREATE FUNCTION f() AS $$ BEGIN; END; $$;", "SELECT f();"}},
+    {"SELECT 1; -- trailing comment\n", ";", []string{"SELECT 1;"}},
+    {"BEGIN; END//\nSELECT 1//", "//", []string{"BEGIN; END", "SELECT 1"}},
+    {"BEGIN; END $$ SELECT 1$$", "$$", []string{"BEGIN; END", "SELECT 1"}},
+    {"SELECT CATEGORY FROM t\nGO\nGOTO x\nGO", "GO", []string{"SELECT CATEGORY FROM t", "GOTO x"}},
+    {"SELECT 1 GO SELECT 'GO' AS ago GO", "GO", []string{"SELECT 1", "SELECT 'GO' AS ago"}},
+    {"SELECT 'oops; SELECT 2;", ";", []string{"SELECT 'oops; SELECT 2;"}},
+    {"-- only a comment", ";", nil},
+    {"", ";", nil},
+  }) {
+    statements := splitStatements(value.sql, value.delimiter, false, false)
+    if strings.Join(statements, "|") != strings.Join(value.statements, "|") || len(statements) != len(value.statements) {
+      t.Errorf("%q: expected %q got %q", value.sql, value.statements, statements)
+    }
+  }
+}
+
+func TestStatementError(t *testing.T) {
+  boom := errors.New("boom")
+  for statement, expected := range(map[string]string{
+    "SELECT 1;":                 "statement 2 (SELECT 1;): boom",
+    "SELECT 1\nFROM t;":         "statement 2 (SELECT 1 ...): boom",
+    strings.Repeat("x", 70):     "statement 2 (" + strings.Repeat("x", 57) + "...): boom",
+  }) {
+    err := &StatementError{Index: 2, Statement: statement, Err: boom}
+    if err.Error() != expected {
+      t.Errorf("expected '%v' got '%v'", expected, err.Error())
+    }
+  }
+}